@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// basicAuthRealm is announced in WWW-Authenticate when credentials are missing.
+const basicAuthRealm = "cors-proxy"
+
+// apiKeyHeader and apiKeyParam are where clients present an -api-keys key.
+const (
+	apiKeyHeader = "X-Api-Key"
+	apiKeyParam  = "api_key"
+)
+
+// publicPaths are served without credentials: probes and build info.
+var publicPaths = []string{"/healthz", "/livez", "/readyz", "/version"}
+
+// withAuth gates every request except publicPaths and CORS preflights, which
+// browsers send without credentials. A request gets through with either the
+// -basic-auth-user/-basic-auth-pass credentials or one of the -api-keys; with
+// neither configured it is a no-op.
+func withAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		basic, keys := cfg().BasicAuthUser != "", len(cfg().APIKeys) > 0
+		if !basic && !keys || isPublicPath(r.URL.Path) || r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ok := basic && checkBasicAuth(r) || keys && checkAPIKey(r)
+		if !ok {
+			setCORSHeaders(w, r)
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+basicAuthRealm+`", charset="UTF-8"`)
+			}
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			countError(http.StatusUnauthorized)
+			logf(r.Context(), "Request rejected: missing or wrong credentials")
+			return
+		}
+		// The credentials are for the proxy, never for the upstream
+		if basic {
+			r.Header.Del("Authorization")
+		}
+		if keys {
+			r.Header.Del(apiKeyHeader)
+			r.URL.RawQuery = stripQueryParam(r.URL.RawQuery, apiKeyParam)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isPublicPath reports whether path is one of publicPaths.
+func isPublicPath(path string) bool {
+	for _, p := range publicPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBasicAuth compares the request's Basic credentials against the
+// configured ones in constant time. Both parts are always compared so the
+// timing doesn't tell which one was wrong.
+func checkBasicAuth(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(cfg().BasicAuthUser))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg().BasicAuthPass))
+	return userOK&passOK == 1
+}
+
+// checkAPIKey reports whether the request presents one of -api-keys, in the
+// X-Api-Key header or the api_key query parameter. Every configured key is
+// compared so that the timing doesn't reveal which one, if any, matched;
+// listing the old and new key at once allows rotating without downtime.
+func checkAPIKey(r *http.Request) bool {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		key = r.URL.Query().Get(apiKeyParam)
+	}
+	if key == "" {
+		return false
+	}
+	match := 0
+	for _, k := range cfg().APIKeys {
+		match |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return match == 1
+}
+
+// stripQueryParam removes every name parameter from rawQuery, leaving the
+// rest byte-for-byte as it was so path-style targets keep their query intact.
+func stripQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, p := range parts {
+		key, _, _ := strings.Cut(p, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
+}
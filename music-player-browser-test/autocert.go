@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertAddr and autocertRedirectAddr are the ports Let's Encrypt expects:
+// TLS-ALPN challenges and HTTPS on 443, HTTP-01 challenges on 80.
+const (
+	autocertAddr         = ":443"
+	autocertRedirectAddr = ":80"
+)
+
+// newAutocertManager builds the certificate manager for -autocert-domains.
+// Certificates are only requested for those names and are kept in
+// -autocert-cache so restarts don't hit the issuer's rate limits.
+func newAutocertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg().AutocertDomains...),
+		Cache:      autocert.DirCache(cfg().AutocertCacheDir),
+	}
+}
+
+// newRedirectServer serves the port 80 side of autocert: ACME HTTP-01
+// challenges, and a redirect to HTTPS for everything else.
+func newRedirectServer(m *autocert.Manager) *http.Server {
+	return &http.Server{Addr: autocertRedirectAddr, Handler: m.HTTPHandler(nil)}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// batchResult is the outcome of fetching one target of a /batch request.
+// Either Error is set or Status, Headers and Body describe the response.
+// Bodies that aren't valid UTF-8 are base64 encoded (BodyEncoding "base64").
+type batchResult struct {
+	URL          string      `json:"url"`
+	Status       int         `json:"status,omitempty"`
+	Headers      http.Header `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// batchHandler accepts a JSON array of target URLs in a POST body, fetches
+// them concurrently with a bounded worker pool and returns a JSON array of
+// results in the same order. A failing target only fails its own item.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		setPreflightHeaders(w, r)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !checkOpenHours(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	// Every item is a GET, so the batch is only as allowed as a GET would be
+	if !corsPolicyFor(r.URL.Path).allowsMethod(http.MethodGet) {
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Batch rejected: method GET is not allowed")
+		return
+	}
+
+	var targets []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&targets); err != nil {
+		writeError(w, http.StatusBadRequest, "Error: Body must be a JSON array of target URLs.")
+		logf(r.Context(), "Batch request failed: %v", err)
+		return
+	}
+	if len(targets) > cfg().BatchMaxItems {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Error: At most %d targets per batch.", cfg().BatchMaxItems))
+		return
+	}
+
+	results := make([]batchResult, len(targets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, cfg().BatchWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = fetchBatchItem(r, targets[j])
+			}
+		}()
+	}
+	for j := range targets {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// fetchBatchItem GETs one target through the same policy, timeouts, retries,
+// rate limit and response header rules as proxyHandler. Each item spends one
+// of the client's -rate tokens, so a batch can't multiply its budget.
+func fetchBatchItem(r *http.Request, target string) batchResult {
+	result := batchResult{URL: target}
+
+	target, err := resolveTarget(target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	target = rewriteTarget(target)
+	if _, terr := checkTarget(target); terr != nil {
+		result.Error = terr.err.Error()
+		return result
+	}
+	if limiter != nil {
+		if ok, _ := limiter.allow(clientIP(r), time.Now()); !ok {
+			metrics.clientErrors.Add(1)
+			result.Error = "rate limit exceeded"
+			return result
+		}
+	}
+	if hostLimit != nil {
+		host := targetHost(target)
+		if !hostLimit.acquire(r, host) {
+			result.Error = fmt.Sprintf("too many concurrent requests to %s", host)
+			return result
+		}
+		defer hostLimit.release(host)
+	}
+
+	ctx, cancel := withTimeout(r.Context(), cfg().Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	setUserAgent(req, r)
+	setHost(req, r)
+	setForwarded(req, r)
+	if id := requestIDFrom(r.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	resp, err := doWithRetry(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !isAllowedContentType(ct) {
+		result.Error = fmt.Sprintf("content type %q is not allowed", ct)
+		return result
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg().BatchMaxBody+1))
+	if err != nil {
+		result.Error = fmt.Sprintf("reading body: %v", err)
+		return result
+	}
+	if int64(len(body)) > cfg().BatchMaxBody {
+		result.Error = fmt.Sprintf("body exceeds -batch-max-body of %d bytes", cfg().BatchMaxBody)
+		return result
+	}
+
+	cleanResponseHeaders(resp.Header)
+	result.Status = resp.StatusCode
+	result.Headers = resp.Header
+	if utf8.Valid(body) {
+		result.Body = string(body)
+	} else {
+		result.Body = base64.StdEncoding.EncodeToString(body)
+		result.BodyEncoding = "base64"
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends targets to batchHandler and decodes the results.
+func postBatch(t *testing.T, targets ...string) (*httptest.ResponseRecorder, []batchResult) {
+	t.Helper()
+	body, _ := json.Marshal(targets)
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(body))))
+	var results []batchResult
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec, results
+}
+
+func TestBatchAppliesRateLimitMethodsAndHeaderRules(t *testing.T) {
+	withConfig(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Foo")
+		w.Header().Set("X-Foo", "1")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	prev := limiter
+	limiter = newRateLimiter(0.001, 2)
+	defer func() { limiter = prev }()
+
+	_, results := postBatch(t, srv.URL+"/a", srv.URL+"/b", srv.URL+"/c")
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	limited := 0
+	for _, res := range results {
+		switch {
+		case res.Error == "rate limit exceeded":
+			limited++
+		case res.Error != "":
+			t.Errorf("%s: unexpected error %q", res.URL, res.Error)
+		case res.Headers.Get("X-Foo") != "" || res.Headers.Get("Connection") != "":
+			t.Errorf("%s: hop-by-hop headers relayed: %v", res.URL, res.Headers)
+		}
+	}
+	if limited != 1 {
+		t.Errorf("%d items were rate limited, want 1 of 3 with a burst of 2", limited)
+	}
+
+	withConfig(t, func(c *Config) { c.AllowMethods = []string{"HEAD", "OPTIONS"} })
+	if rec, _ := postBatch(t, srv.URL+"/a"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("batch with GET not allowed: got %d, want 405", rec.Code)
+	}
+}
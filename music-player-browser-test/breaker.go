@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned by doWithRetry instead of contacting a host whose
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open for target host")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// hostCircuit is the breaker state of a single upstream host.
+type hostCircuit struct {
+	state        circuitState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+// circuitBreaker trips a host open after threshold consecutive failures within
+// window. While open, requests to the host fail fast; after cooldown a single
+// probe request is let through (half-open) and its outcome decides whether
+// the circuit closes again or stays open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	hosts     map[string]*hostCircuit
+}
+
+// breaker is built in main when breaker-failures is set; nil disables it.
+var breaker *circuitBreaker
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostCircuit),
+	}
+}
+
+// allow reports whether a request to host may be sent now.
+func (b *circuitBreaker) allow(ctx context.Context, host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case circuitOpen:
+		if now.Sub(c.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(ctx, host, c, circuitHalfOpen)
+		c.probing = true
+		return true
+	case circuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+// record feeds the outcome of a request to host, as returned by client.Do,
+// into the breaker. Failures are the same ones doWithRetry would retry:
+// network errors, timeouts and 5xx responses.
+func (b *circuitBreaker) record(ctx context.Context, host string, resp *http.Response, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if errors.Is(err, context.Canceled) {
+		// The client went away; that says nothing about the host, but a
+		// half-open probe has to be given up so another one can run
+		if ok {
+			c.probing = false
+		}
+		return
+	}
+	failed := isRetryable(resp, err)
+
+	if !failed {
+		if ok {
+			if c.state != circuitClosed {
+				b.transition(ctx, host, c, circuitClosed)
+			}
+			// Healthy hosts need no state, which keeps the map small
+			delete(b.hosts, host)
+		}
+		return
+	}
+
+	if !ok {
+		c = &hostCircuit{}
+		b.hosts[host] = c
+	}
+	switch c.state {
+	case circuitHalfOpen:
+		c.probing = false
+		c.openedAt = now
+		b.transition(ctx, host, c, circuitOpen)
+	case circuitClosed:
+		if c.failures == 0 || now.Sub(c.firstFailure) > b.window {
+			c.failures, c.firstFailure = 0, now
+		}
+		c.failures++
+		if c.failures >= b.threshold {
+			c.openedAt = now
+			b.transition(ctx, host, c, circuitOpen)
+		}
+	}
+}
+
+// transition moves c to state and logs the change. b.mu must be held.
+func (b *circuitBreaker) transition(ctx context.Context, host string, c *hostCircuit, state circuitState) {
+	logf(ctx, "Circuit breaker for %s: %s -> %s", host, c.state, state)
+	c.state = state
+	if state == circuitClosed {
+		c.failures = 0
+	}
+}
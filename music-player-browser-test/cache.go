@@ -0,0 +1,401 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheEntry is one stored upstream response. Its body is either held in
+// body or, in a disk-backed cache, written to file.
+type cacheEntry struct {
+	key     string
+	base    string // the cacheKey the entry's variant was picked under
+	status  int
+	header  http.Header
+	body    []byte
+	file    string
+	size    int64
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is an in-memory LRU of upstream responses bounded by the
+// total size of the stored bodies.
+type responseCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	stale    time.Duration // how long expired entries are kept for getStale
+	dir      string        // where bodies are written; empty keeps them in memory
+	maxBytes int64
+	used     int64
+	lru      *list.List // front is most recently used
+	items    map[string]*list.Element
+	variants map[string]*variants // by cacheKey
+
+	// Counted without c.mu so reading them never contends with requests
+	hits, misses, evictions atomic.Int64
+}
+
+// cache is built in main when cache-ttl is set; nil disables caching.
+var cache *responseCache
+
+func newResponseCache(ttl, stale time.Duration, maxBytes int64) *responseCache {
+	return &responseCache{
+		ttl:      ttl,
+		stale:    stale,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		variants: make(map[string]*variants),
+	}
+}
+
+// diskFilePattern names the body files of a disk-backed cache, so stale
+// ones left by an earlier run can be told apart from anything else.
+const diskFilePattern = "body-*"
+
+// newDiskCache returns a cache that keeps response bodies as files in dir,
+// bounded by maxBytes of disk instead of memory. Hits on those files can be
+// served by http.ServeContent. Files left in dir by an earlier run are
+// removed, since nothing refers to them any more.
+func newDiskCache(ttl, stale time.Duration, maxBytes int64, dir string) (*responseCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, diskFilePattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range leftovers {
+		os.Remove(name)
+	}
+	c := newResponseCache(ttl, stale, maxBytes)
+	c.dir = dir
+	return c, nil
+}
+
+// writeBodyFile stores body in a new file in c.dir and returns its name.
+func (c *responseCache) writeBodyFile(body []byte) (string, error) {
+	f, err := os.CreateTemp(c.dir, diskFilePattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// variants records the request headers an upstream listed in Vary for the
+// responses stored under one cacheKey, and how many of them are stored.
+type variants struct {
+	headers []string
+	count   int
+}
+
+// varyHeaders returns the request headers the upstream response header h
+// varies on, in canonical form. An encoded body is relayed as is, so it only
+// suits clients with the same Accept-Encoding even if the upstream didn't
+// say so; an unencoded one suits everybody.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	if h.Get("Content-Encoding") != "" && !containsFold(names, "Accept-Encoding") {
+		names = append(names, "Accept-Encoding")
+	}
+	return names
+}
+
+// variantKey extends base with r's values for the Vary headers, so each
+// variant of a response is stored under a key of its own.
+func variantKey(base string, headers []string, r *http.Request) string {
+	key := base
+	for _, name := range headers {
+		key += "\x00" + name + "=" + strings.Join(r.Header.Values(name), ",")
+	}
+	return key
+}
+
+// cacheKey identifies a cached response by target URL and requested range,
+// since the upstream may answer each differently. The request headers the
+// upstream's Vary names are added per variant, see variantKey.
+func cacheKey(target string, r *http.Request) string {
+	return target + "\x00" + r.Header.Get("Range")
+}
+
+// get returns the live entry for the variant of base that r asks for, if
+// any. Expired entries are dropped once they are too old for getStale.
+func (c *responseCache) get(base string, r *http.Request, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.lookup(base, r, now)
+	if !ok || now.After(el.Value.(*cacheEntry).expires) {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits.Add(1)
+	return el.Value.(*cacheEntry), true
+}
+
+// getFull returns the live disk-backed entry holding the whole of target's
+// body, for a Range request that missed: http.ServeContent can cut any
+// range out of the file. Only a hit is counted, since the range lookup
+// already counted the miss.
+func (c *responseCache) getFull(target string, r *http.Request, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.lookup(target+"\x00", r, now)
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.file == "" || entry.status != http.StatusOK || now.After(entry.expires) {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits.Add(1)
+	return entry, true
+}
+
+// getStale returns the entry for the variant of base that r asks for even if
+// it has expired, as long as it did so at most c.stale ago. It is the
+// fallback for a failed upstream fetch and doesn't count as a hit or miss.
+func (c *responseCache) getStale(base string, r *http.Request, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.lookup(base, r, now)
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// lookup finds the element for the variant of base that r asks for, dropping
+// it if it expired more than c.stale ago. The caller must hold c.mu.
+func (c *responseCache) lookup(base string, r *http.Request, now time.Time) (*list.Element, bool) {
+	key := base
+	if v := c.variants[base]; v != nil {
+		key = variantKey(base, v.headers, r)
+	}
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(el.Value.(*cacheEntry).expires.Add(c.stale)) {
+		c.removeElement(el)
+		return nil, false
+	}
+	return el, true
+}
+
+// set stores a response to r under base, as the variant its Vary header
+// selects, evicting least recently used entries until it fits. Bodies larger
+// than the whole cache are not stored. A disk-backed cache writes the body
+// to a file first and doesn't store it if that fails.
+func (c *responseCache) set(base string, r *http.Request, status int, header http.Header, body []byte, now time.Time) {
+	size := int64(len(body))
+	if size > c.maxBytes {
+		return
+	}
+	vary := varyHeaders(header)
+	key := variantKey(base, vary, r)
+
+	var file string
+	if c.dir != "" {
+		var err error
+		if file, err = c.writeBodyFile(body); err != nil {
+			log.Printf("Not caching a response: %v", err)
+			return
+		}
+		body = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	for c.used+size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		c.evictions.Add(1)
+	}
+
+	// The latest response decides which headers later lookups vary on
+	v := c.variants[base]
+	if v == nil {
+		v = &variants{}
+		c.variants[base] = v
+	}
+	v.headers = vary
+	v.count++
+
+	entry := &cacheEntry{
+		key:     key,
+		base:    base,
+		status:  status,
+		header:  header.Clone(),
+		body:    body,
+		file:    file,
+		size:    size,
+		stored:  now,
+		expires: now.Add(c.ttl),
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	c.used += size
+}
+
+// purge removes the entries stored for target and returns how many there
+// were. With rangeHeader set only that range is removed; otherwise every
+// range, encoding and variant of target goes.
+func (c *responseCache) purge(target, rangeHeader string) int {
+	prefix := target + "\x00"
+	if rangeHeader != "" {
+		prefix += rangeHeader
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, el := range c.items {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if ok && (rangeHeader == "" || rest == "" || strings.HasPrefix(rest, "\x00")) {
+			c.removeElement(el)
+			n++
+		}
+	}
+	return n
+}
+
+// purgeAll empties the cache and returns how many entries it held.
+func (c *responseCache) purgeAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.lru.Len()
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if file := el.Value.(*cacheEntry).file; file != "" {
+			os.Remove(file)
+		}
+	}
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.variants = make(map[string]*variants)
+	c.used = 0
+	return n
+}
+
+// cacheStats is the /cache/stats view of a responseCache.
+type cacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// stats reports the cache's size and its lookup counters. Evictions only
+// count entries pushed out to make room, not expired or purged ones.
+func (c *responseCache) stats() cacheStats {
+	c.mu.Lock()
+	entries, used := len(c.items), c.used
+	c.mu.Unlock()
+
+	return cacheStats{
+		Entries:   entries,
+		Bytes:     used,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// removeElement unlinks el. The caller must hold c.mu.
+func (c *responseCache) removeElement(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.items, entry.key)
+	c.used -= entry.size
+	if entry.file != "" {
+		// A hit still being served keeps reading the open, unlinked file
+		os.Remove(entry.file)
+	}
+	if v := c.variants[entry.base]; v != nil {
+		if v.count--; v.count == 0 {
+			delete(c.variants, entry.base)
+		}
+	}
+}
+
+// isCacheable reports whether an upstream response may be stored. One that
+// varies on "*" differs per request and a private one belongs to a single
+// user, so neither ever is.
+func isCacheable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.EqualFold(directive, "no-store") || strings.EqualFold(strings.SplitN(directive, "=", 2)[0], "private") {
+			return false
+		}
+	}
+	return true
+}
+
+// cappedBuffer collects written bytes up to limit. Once the limit is
+// exceeded it discards everything, reports overflowed and calls onOverflow,
+// if set, but never fails the write so it can sit behind an io.MultiWriter
+// next to the client.
+type cappedBuffer struct {
+	buf        []byte
+	limit      int64
+	overflowed bool
+	onOverflow func()
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflowed {
+		if int64(len(b.buf)+len(p)) > b.limit {
+			b.overflowed = true
+			b.buf = nil
+			if b.onOverflow != nil {
+				b.onOverflow()
+			}
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
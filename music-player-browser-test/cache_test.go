@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheServesRangesAndRevalidation(t *testing.T) {
+	withConfig(t, nil)
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "body-old")
+	if err := os.WriteFile(leftover, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newDiskCache(time.Minute, 0, 1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("leftover body file survived newDiskCache: %v", err)
+	}
+	withCache(t, c)
+
+	up := &upstreamCalls{next: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("0123456789"))
+	}}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+	target := "/?target=" + url.QueryEscape(srv.URL+"/song.mp3")
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, req)
+		return rec
+	}
+
+	if rec := get(nil); rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("miss: got %d %q", rec.Code, rec.Body.String())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, diskFilePattern))
+	if len(files) != 1 {
+		t.Fatalf("got %d body files after one miss, want 1", len(files))
+	}
+
+	rec := get(nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("hit: got %d %q X-Cache=%q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+
+	rec = get(http.Header{"Range": {"bytes=2-4"}})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Fatalf("range: got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 2-4/10" {
+		t.Errorf("Content-Range = %q", got)
+	}
+
+	rec = get(http.Header{"If-None-Match": {`"v1"`}})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("revalidation: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if up.n != 1 {
+		t.Errorf("upstream was asked %d times, want 1", up.n)
+	}
+	if n := c.purgeAll(); n != 1 {
+		t.Errorf("purgeAll removed %d entries, want 1", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, diskFilePattern)); len(files) != 0 {
+		t.Errorf("body files left after purgeAll: %v", files)
+	}
+}
+
+func TestDiskCacheFallsBackWhenFileIsGone(t *testing.T) {
+	withConfig(t, nil)
+	c, err := newDiskCache(time.Minute, 0, 1<<20, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCache(t, c)
+
+	up := &upstreamCalls{next: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("audio")) }}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+	target := "/?target=" + url.QueryEscape(srv.URL)
+
+	proxyHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	files, _ := filepath.Glob(filepath.Join(c.dir, diskFilePattern))
+	for _, name := range files {
+		os.Remove(name)
+	}
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio" || rec.Header().Get("X-Cache") == "HIT" {
+		t.Fatalf("got %d %q X-Cache=%q, want a fresh fetch", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if up.n != 2 {
+		t.Errorf("upstream was asked %d times, want 2", up.n)
+	}
+}
+
+func TestIsCacheable(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		header http.Header
+		want   bool
+	}{
+		{http.StatusOK, http.Header{}, true},
+		{http.StatusPartialContent, http.Header{}, true},
+		{http.StatusNotFound, http.Header{}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60, private"}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{http.StatusOK, http.Header{"Vary": {"*"}}, false},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: tc.header}
+		if got := isCacheable(resp); got != tc.want {
+			t.Errorf("isCacheable(%d, %v) = %v, want %v", tc.status, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestCacheStoresVaryVariantsSeparately(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ForwardHeaders = []string{"Accept"} })
+	withCache(t, newResponseCache(time.Minute, 0, 1<<20))
+	up := &upstreamCalls{next: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/star" {
+			w.Header().Set("Vary", "*")
+		} else {
+			w.Header().Set("Vary", "Accept, Accept-Encoding")
+		}
+		w.Write([]byte("v:" + r.Header.Get("Accept") + "|" + r.Header.Get("Accept-Encoding")))
+	}}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		accept, encoding, want string
+	}{
+		{"", "identity", "v:|identity"},
+		{"", "br", "v:|br"},
+		{"audio/mpeg", "br", "v:audio/mpeg|br"},
+		{"", "br", "v:|br"},
+		{"audio/mpeg", "br", "v:audio/mpeg|br"},
+		{"", "identity", "v:|identity"},
+	} {
+		header := http.Header{"Accept-Encoding": {tc.encoding}}
+		if tc.accept != "" {
+			header.Set("Accept", tc.accept)
+		}
+		if got := proxyGet(srv.URL+"/song", header).Body.String(); got != tc.want {
+			t.Errorf("Accept %q, Accept-Encoding %q: got %q, want %q", tc.accept, tc.encoding, got, tc.want)
+		}
+	}
+	if up.n != 3 {
+		t.Errorf("upstream was asked %d times, want once per variant (3)", up.n)
+	}
+	if n := cache.stats().Entries; n != 3 {
+		t.Errorf("cache holds %d entries, want 3", n)
+	}
+
+	proxyGet(srv.URL+"/star", nil)
+	proxyGet(srv.URL+"/star", nil)
+	if up.n != 5 {
+		t.Errorf("a Vary: * response was served from the cache")
+	}
+
+	cache.purge(srv.URL+"/song", "")
+	if len(cache.variants) != 0 {
+		t.Errorf("purge left variant records: %v", cache.variants)
+	}
+}
+
+func TestServeStaleOnUpstreamFailure(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ServeStale = time.Hour })
+	withCache(t, newResponseCache(time.Minute, time.Hour, 1<<20))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	target := srv.URL + "/song.mp3"
+
+	// store expires its entries a minute after they are stored
+	storeAt := func(target string, age time.Duration) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		header := http.Header{"Content-Type": {"audio/mpeg"}}
+		cache.set(cacheKey(target, r), r, http.StatusOK, header, []byte("song"), time.Now().Add(-age))
+	}
+	isStale := func(rec *httptest.ResponseRecorder) bool {
+		return rec.Code == http.StatusOK && rec.Body.String() == "song" &&
+			rec.Header().Get("X-Cache") == "STALE" && rec.Header().Get("Warning") == `110 - "Response is Stale"`
+	}
+
+	storeAt(target, 2*time.Minute)
+	if rec := proxyGet(target, nil); !isStale(rec) {
+		t.Errorf("upstream 502: got %d %q, headers %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	srv.Close()
+	if rec := proxyGet(target, nil); !isStale(rec) {
+		t.Errorf("upstream down: got %d %q, headers %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	storeAt(target, 2*time.Hour)
+	if rec := proxyGet(target, nil); rec.Code != http.StatusBadGateway || rec.Header().Get("Warning") != "" {
+		t.Errorf("a copy past -serve-stale-on-error was served: got %d, headers %v", rec.Code, rec.Header())
+	}
+}
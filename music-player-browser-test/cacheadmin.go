@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// cachePurgeHandler serves POST /cache/purge?target=<url>[&range=<Range>],
+// evicting the cached responses for target, or POST /cache/purge?all=true,
+// emptying the cache. target names the entries as a ?target= proxy request
+// would: other query parameters are appended and -rewrite-rules applied.
+// It replies with the number of entries removed. Like the proxy routes it
+// sits behind withAuth.
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	if cache == nil {
+		writeError(w, http.StatusNotFound, "Not Found: Caching is disabled.")
+		return
+	}
+
+	q := r.URL.Query()
+	var purged int
+	if q.Get("all") == "true" {
+		purged = cache.purgeAll()
+		logf(r.Context(), "Purged all %d cache entries", purged)
+	} else {
+		target, err := targetFromQuery(q)
+		if err == nil {
+			target, err = resolveTarget(target)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Error: 'target' query parameter is missing or malformed.")
+			logf(r.Context(), "Cache purge rejected: %v", err)
+			return
+		}
+		// Find the entries under the target the proxy fetched, which carries
+		// any extra query parameters and is rewritten by -rewrite-rules
+		extra := url.Values{}
+		for key, values := range q {
+			if key != "range" && key != "all" {
+				extra[key] = values
+			}
+		}
+		target = proxiedTarget(r.Context(), target, extra)
+		purged = cache.purge(target, q.Get("range"))
+		logf(r.Context(), "Purged %d cache entries for %s", purged, target)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+// cacheStatsHandler serves GET /cache/stats: the cache's entry count, bytes
+// used and hit, miss and eviction counters, for sizing -cache-max-bytes.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if cache == nil {
+		writeError(w, http.StatusNotFound, "Not Found: Caching is disabled.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cache.stats())
+}
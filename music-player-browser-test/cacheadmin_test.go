@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCachePurgeFindsRewrittenTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+	withConfig(t, func(c *Config) {
+		c.RewriteRules = []RewriteRule{{
+			Match:   urlPattern{regexp.MustCompile(`^https://old\.cdn\.example/`)},
+			Replace: srv.URL + "/",
+		}}
+	})
+	withCache(t, newResponseCache(time.Minute, 0, 1<<20))
+
+	purge := func(q url.Values) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		cachePurgeHandler(rec, httptest.NewRequest(http.MethodPost, "/cache/purge?"+q.Encode(), nil))
+		var body map[string]int
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("purge replied %d %q", rec.Code, rec.Body.String())
+		}
+		return body["purged"]
+	}
+
+	target := "https://old.cdn.example/song.mp3"
+	proxyGet(target, nil)
+	if n := purge(url.Values{"target": {target}}); n != 1 {
+		t.Errorf("purging the rewritten target removed %d entries, want 1", n)
+	}
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?"+url.Values{"target": {target}, "q": {"jazz"}}.Encode(), nil))
+	if n := purge(url.Values{"target": {target}}); n != 0 {
+		t.Errorf("purging without the extra parameter removed %d entries, want 0", n)
+	}
+	if n := purge(url.Values{"target": {target}, "q": {"jazz"}}); n != 1 {
+		t.Errorf("purging with the extra parameter removed %d entries, want 1", n)
+	}
+	if n := cache.stats().Entries; n != 0 {
+		t.Errorf("%d entries left after purging", n)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// runCheck implements the check subcommand: it fetches args[0] once through
+// proxyHandler, exactly as a client's ?target= request would be, and prints
+// the status and headers the client would get. It returns the process exit
+// code: 0 for a successful response, 1 otherwise and 2 for bad usage.
+func runCheck(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: check [flags] <url>")
+		return 2
+	}
+	req, err := http.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(args[0]), http.NoBody)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	w := &checkWriter{header: http.Header{}}
+	aborted := serveCheck(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	fmt.Printf("%d %s\n", w.status, http.StatusText(w.status))
+	w.header.Write(os.Stdout)
+	fmt.Printf("\n%d body bytes\n", w.bytes)
+	if aborted {
+		fmt.Println("body truncated: the response was aborted mid-body (see -max-body)")
+		return 1
+	}
+	if w.status >= 400 {
+		return 1
+	}
+	return 0
+}
+
+// serveCheck runs proxyHandler for r and reports whether it aborted the
+// response with http.ErrAbortHandler, as it does when a body is cut short.
+// A server would recover that panic by dropping the connection; here it
+// turns into a failed check instead of a crash.
+func serveCheck(w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			aborted = true
+		}
+	}()
+	proxyHandler(w, r)
+	return false
+}
+
+// checkWriter is the http.ResponseWriter runCheck hands to proxyHandler. It
+// keeps the status and headers and counts, then discards, the body.
+type checkWriter struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (w *checkWriter) Header() http.Header { return w.header }
+
+func (w *checkWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *checkWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
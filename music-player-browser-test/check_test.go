@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunCheckExitStatus(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxBody = 8 })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/big":
+			// Unknown length, so only the copy notices the limit
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 64))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	for path, want := range map[string]int{"/song.mp3": 0, "/missing": 1, "/big": 1} {
+		if got := runCheck([]string{srv.URL + path}); got != want {
+			t.Errorf("check %s exited %d, want %d", path, got, want)
+		}
+	}
+	if got := runCheck(nil); got != 2 {
+		t.Errorf("check without a URL exited %d, want 2", got)
+	}
+}
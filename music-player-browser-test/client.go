@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errRedirectBlocked is returned by checkRedirect when an upstream redirect
+// points somewhere the proxy is not allowed to go.
+var errRedirectBlocked = errors.New("redirect target is not allowed")
+
+// errRedirectLoop is returned by checkRedirect when an upstream keeps
+// redirecting, either back to a URL already visited or past -max-redirects.
+var errRedirectLoop = errors.New("redirect loop")
+
+// client is shared by every proxied request so upstream connections are
+// pooled and reused. It is built in main once the configuration is loaded.
+var client *http.Client
+
+// newClient builds the shared upstream client from the configuration.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   cfg().DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxyURL, _ := parseUpstreamProxy(cfg().UpstreamProxy)
+	transport.DialContext = cachedDialContext(dialer.DialContext, proxyDialAddr(proxyURL))
+	transport.ResponseHeaderTimeout = cfg().ResponseHeaderTimeout
+	transport.MaxIdleConns = cfg().MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg().MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = cfg().MaxConnsPerHost
+	transport.IdleConnTimeout = cfg().IdleConnTimeout
+	// Bodies are relayed in whatever encoding the upstream chose for the
+	// client's own Accept-Encoding, so never let the transport decode them
+	transport.DisableCompression = true
+	// HTTPS upstreams are offered HTTP/2 so concurrent range requests can
+	// share one connection; a non-nil empty TLSNextProto turns that off
+	transport.ForceAttemptHTTP2 = !cfg().DisableHTTP2
+	if cfg().DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if tlsConfig, err := upstreamTLSConfig(cfg()); err == nil && tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	var rt http.RoundTripper = transport
+	if cfg().Debug {
+		rt = debugTransport{next: transport}
+	}
+	return &http.Client{
+		Transport:     rt,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// parseUpstreamProxy parses -upstream-proxy. The transport speaks HTTP
+// CONNECT to http(s) proxies and SOCKS5 to socks5 ones. An empty value means
+// no proxy and returns nil.
+func parseUpstreamProxy(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("upstream-proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("upstream-proxy %q: scheme must be http, https or socks5", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream-proxy %q: missing host", u.Redacted())
+	}
+	return u, nil
+}
+
+// proxyDialAddr returns the host:port the transport dials for the upstream
+// proxy u, or "" when there is none.
+func proxyDialAddr(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// upstreamTLSConfig builds the TLS settings for upstream connections from
+// -upstream-client-cert, -upstream-ca and -insecure-skip-verify, or returns
+// nil to keep Go's defaults when none is set. Validate calls it too, so a missing file, a
+// key that doesn't match its certificate or a bundle without certificates
+// stops the proxy at startup rather than failing the first handshake.
+func upstreamTLSConfig(c *Config) (*tls.Config, error) {
+	if c.UpstreamClientCert == "" && c.UpstreamCA == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.UpstreamClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.UpstreamClientCert, c.UpstreamClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("upstream-client-cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.UpstreamCA != "" {
+		pem, err := os.ReadFile(c.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("upstream-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if c.UpstreamCASystem {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("upstream-ca-system: %v", err)
+			}
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream-ca: no PEM certificates could be parsed from %s", c.UpstreamCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// checkRedirect applies the proxy's target policy to every redirect hop, so a
+// 302 can't be used to escape the host or port allowlist, reach a blocked
+// host or reach a private address.
+// With -follow-redirects=false the 3xx response itself is relayed.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if !cfg().FollowRedirects {
+		return http.ErrUseLastResponse
+	}
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return fmt.Errorf("%w: %s", errRedirectLoop, redirectChain(req, via))
+		}
+	}
+	if len(via) >= cfg().MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects: %s", errRedirectLoop, len(via), redirectChain(req, via))
+	}
+
+	if terr := checkTargetURL(req.URL); terr != nil {
+		return fmt.Errorf("%w: %v", errRedirectBlocked, terr.err)
+	}
+	return nil
+}
+
+// redirectChain renders the URLs visited so far, ending with req, for logs.
+func redirectChain(req *http.Request, via []*http.Request) string {
+	urls := make([]string, 0, len(via)+1)
+	for _, prev := range via {
+		urls = append(urls, prev.URL.String())
+	}
+	return strings.Join(append(urls, req.URL.String()), " -> ")
+}
+
+// doWithRetry sends req on the shared client, retrying GET and HEAD requests
+// on network errors and 5xx responses with exponential backoff. It runs before
+// anything is written to the client, so a retry never duplicates body bytes.
+// Every attempt goes through the host's circuit breaker, which may refuse it
+// with errCircuitOpen.
+func doWithRetry(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	backoff := cfg().RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		if breaker != nil && !breaker.allow(req.Context(), req.URL.Host, time.Now()) {
+			return nil, errCircuitOpen
+		}
+		out := req.Clone(req.Context())
+		var span trace.Span
+		if tracingEnabled {
+			span = startUpstreamSpan(out)
+		}
+		resp, err := client.Do(out)
+		if span != nil {
+			endUpstreamSpan(span, resp, err)
+		}
+		if breaker != nil {
+			breaker.record(req.Context(), req.URL.Host, resp, err, time.Now())
+		}
+		if !idempotent || attempt >= cfg().Retries || !isRetryable(resp, err) {
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+		logf(req.Context(), "Retrying %s (attempt %d of %d) in %s: %s", req.URL, attempt+1, cfg().Retries, backoff, reason)
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryable reports whether an attempt failed in a way worth retrying.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// Policy rejections and client disconnects won't improve on retry
+		return !errors.Is(err, errRedirectBlocked) && !errors.Is(err, errRedirectLoop) && !errors.Is(err, errPrivateAddress) &&
+			!errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode >= 500
+}
+
+// requestTimeout returns the upstream timeout for a ?target= request: the
+// ?timeout= query parameter when present, capped at -max-timeout, otherwise
+// -timeout.
+func requestTimeout(q url.Values) (time.Duration, error) {
+	raw := q.Get("timeout")
+	if raw == "" {
+		return cfg().Timeout, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", raw)
+	}
+	if cfg().MaxTimeout > 0 && d > cfg().MaxTimeout {
+		d = cfg().MaxTimeout
+	}
+	return d, nil
+}
+
+// withTimeout derives the context for an upstream fetch. The deadline is set
+// per request rather than on the shared client so it can be overridden, and
+// it covers retries and reading the body. A zero timeout means no deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// upstreamErrorStatus maps a failed upstream fetch to the status to answer
+// with: 504 when a deadline expired, 502 when talking to the upstream failed
+// (refused or reset connections, DNS and TLS failures, malformed responses;
+// client.Do reports all of these as *url.Error), and 500 for anything else,
+// which would be the proxy's own fault.
+func upstreamErrorStatus(err error) int {
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// isTimeout reports whether err from an upstream fetch was caused by one of
+// the configured deadlines expiring.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRedirectLoopsAreDetected(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxRedirects = 5 })
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chain" {
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			http.Redirect(w, r, "/chain?n="+strconv.Itoa(n+1), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, srv.URL+"/self", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/self", "/chain"} {
+		if rec := proxyGet(srv.URL+path, nil); rec.Code != http.StatusLoopDetected {
+			t.Errorf("%s: got %d, want 508", path, rec.Code)
+		}
+	}
+}
+
+func TestUpstreamFailuresMapTo502And504(t *testing.T) {
+	withConfig(t, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	garbage, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer garbage.Close()
+	go func() {
+		for {
+			c, err := garbage.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("not http at all\r\n\r\n"))
+			c.Close()
+		}
+	}()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	for _, tc := range []struct {
+		name, target, timeout string
+		want                  int
+	}{
+		{"connection refused", "http://" + refused + "/", "", http.StatusBadGateway},
+		{"malformed response", "http://" + garbage.Addr().String() + "/", "", http.StatusBadGateway},
+		{"deadline exceeded", slow.URL, "20ms", http.StatusGatewayTimeout},
+	} {
+		q := url.Values{"target": {tc.target}}
+		if tc.timeout != "" {
+			q.Set("timeout", tc.timeout)
+		}
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+
+	if got := upstreamErrorStatus(errors.New("bug")); got != http.StatusInternalServerError {
+		t.Errorf("an internal error maps to %d, want 500", got)
+	}
+}
+
+func TestUpstreamNegotiatesHTTP2(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proto = r.Proto }))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for disable, want := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		withConfig(t, func(c *Config) { c.DisableHTTP2 = disable })
+		// Trust the test server's certificate without giving up the
+		// transport's own ALPN settings
+		tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		tlsConfig.NextProtos = nil
+		client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+
+		proto = ""
+		if rec := proxyGet(srv.URL, nil); rec.Code != http.StatusOK {
+			t.Fatalf("disable-http2=%v: got %d", disable, rec.Code)
+		}
+		if proto != want {
+			t.Errorf("disable-http2=%v: upstream saw %s, want %s", disable, proto, want)
+		}
+	}
+}
+
+func TestUpstreamCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	withConfig(t, nil)
+	if rec := proxyGet(srv.URL, nil); rec.Code != http.StatusBadGateway {
+		t.Errorf("without -upstream-ca: got %d, want 502", rec.Code)
+	}
+	for _, system := range []bool{false, true} {
+		withConfig(t, func(c *Config) {
+			c.UpstreamCA = path
+			c.UpstreamCASystem = system
+		})
+		if rec := proxyGet(srv.URL, nil); rec.Code != http.StatusOK {
+			t.Errorf("with -upstream-ca (system roots %v): got %d, want 200", system, rec.Code)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("junk"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.UpstreamCA = path
+	if err := c.Validate(); err == nil {
+		t.Error("Validate accepted an -upstream-ca without certificates")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipPrefix is a -trusted-proxies entry: a CIDR block, or a bare IP standing
+// for just that address.
+type ipPrefix struct{ netip.Prefix }
+
+func parseIPPrefix(s string) (ipPrefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return ipPrefix{p.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return ipPrefix{}, fmt.Errorf("%q is not an IP address or CIDR block", s)
+	}
+	return ipPrefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// UnmarshalText lets config files list prefixes as plain strings.
+func (p *ipPrefix) UnmarshalText(text []byte) error {
+	parsed, err := parseIPPrefix(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// prefixListValue is a flag.Value for a comma-separated list of ipPrefixes.
+type prefixListValue struct{ list *[]ipPrefix }
+
+func (v prefixListValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	parts := make([]string, len(*v.list))
+	for i, p := range *v.list {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (v prefixListValue) Set(s string) error {
+	var list []ipPrefix
+	for _, item := range splitList(s) {
+		p, err := parseIPPrefix(item)
+		if err != nil {
+			return err
+		}
+		list = append(list, p)
+	}
+	*v.list = list
+	return nil
+}
+
+// peerIP returns the address of the immediate peer of r.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip belongs to a proxy whose X-Forwarded-For
+// we believe. -trust-forwarded-for trusts every address.
+func isTrustedProxy(ip string) bool {
+	if cfg().TrustForwardedFor {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range cfg().TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP identifies the client behind r for rate limiting and logging.
+// X-Forwarded-For is only consulted when the peer is a trusted proxy, and
+// then read from the right: the first address not belonging to a trusted
+// proxy is the one the nearest trusted hop saw, and anything to its left
+// may have been made up by the client. If every hop is trusted the leftmost
+// entry is used.
+func clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	lb, err := parseIPPrefix("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(c *Config) { c.TrustedProxies = []ipPrefix{lb} })
+
+	for _, tc := range []struct {
+		name, peer, xff, want string
+	}{
+		{"untrusted peer ignores the header", "203.0.113.9:4000", "1.1.1.1", "203.0.113.9"},
+		{"trusted peer, one hop", "10.0.0.1:4000", "1.1.1.1", "1.1.1.1"},
+		{"spoofed entries left of the real client", "10.0.0.1:4000", "6.6.6.6, 1.1.1.1, 10.0.0.2", "1.1.1.1"},
+		{"every hop trusted", "10.0.0.1:4000", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"trusted peer without the header", "10.0.0.1:4000", "", "10.0.0.1"},
+		{"IPv4-mapped trusted peer", "[::ffff:10.0.0.1]:4000", "1.1.1.1", "1.1.1.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
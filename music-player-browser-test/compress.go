@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// compressWriter returns the writer the relayed body should be copied into.
+// When the response qualifies for gzip it adjusts the headers in h and wraps
+// w; the returned close function must be called after the copy to flush it.
+func compressWriter(w io.Writer, r *http.Request, h http.Header, status int) (io.Writer, func() error) {
+	if !shouldCompress(r, h, status) {
+		return w, func() error { return nil }
+	}
+
+	// The length changes once re-encoded, so let the server fall back to chunking
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+
+	gz := gzip.NewWriter(w)
+	return gz, gz.Close
+}
+
+// shouldCompress reports whether a response with header h and status should
+// be gzipped for r.
+func shouldCompress(r *http.Request, h http.Header, status int) bool {
+	if !cfg().Compress || r.Method == http.MethodHead {
+		return false
+	}
+	// Compressing part of a file would break the byte offsets in Content-Range
+	if status != http.StatusOK {
+		return false
+	}
+	// Already-encoded bodies pass through untouched; only identity is re-encoded
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	return acceptsGzip(r) && isCompressibleType(h.Get("Content-Type"))
+}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// isCompressibleType reports whether contentType is text-like. Audio, images
+// and other binary formats are already compressed and are left alone.
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCompressionFollowsUpstreamEncoding(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Compress = true })
+	const plain = `{"hello":"world"}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(plain))
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch enc := r.URL.Query().Get("enc"); enc {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz.Bytes())
+		case "identity":
+			w.Header().Set("Content-Encoding", enc)
+			fallthrough
+		default:
+			w.Write([]byte(plain))
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		upstream, accept string
+		want             string // "plain", "passthrough" or "compressed"
+	}{
+		{"", "", "plain"},
+		{"", "gzip", "compressed"},
+		{"identity", "", "plain"},
+		{"identity", "gzip", "compressed"},
+		{"gzip", "", "passthrough"},
+		{"gzip", "gzip", "passthrough"},
+	} {
+		name := tc.upstream + "/" + tc.accept
+		rec := proxyGet(srv.URL+"/?enc="+url.QueryEscape(tc.upstream), http.Header{"Accept-Encoding": {tc.accept}})
+		ce, body := rec.Header().Get("Content-Encoding"), rec.Body.Bytes()
+		switch tc.want {
+		case "plain":
+			if string(body) != plain || (ce != "" && ce != "identity") {
+				t.Errorf("%s: got %q encoded %q, want it unchanged", name, body, ce)
+			}
+		case "passthrough":
+			if ce != "gzip" || !bytes.Equal(body, gz.Bytes()) {
+				t.Errorf("%s: the upstream's gzip body was not relayed untouched (Content-Encoding %q)", name, ce)
+			}
+		case "compressed":
+			if ce != "gzip" || rec.Header().Get("Content-Length") != "" {
+				t.Errorf("%s: Content-Encoding %q, Content-Length %q", name, ce, rec.Header().Get("Content-Length"))
+				continue
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if got, _ := io.ReadAll(zr); string(got) != plain {
+				t.Errorf("%s: decompressed to %q", name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// newConcurrencyLimit returns middleware that caps the number of requests in
+// flight across every handler it wraps, using a buffered channel as a
+// semaphore. The slot is released by a deferred call, so every return path in
+// the wrapped handler gives it back.
+func newConcurrencyLimit(limit int, mode string, wait time.Duration) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(h http.Handler) http.Handler { return h }
+	}
+	slots := make(chan struct{}, limit)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acquireSlot(r, slots, mode, wait) {
+				setCORSHeaders(w, r)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, "Service Unavailable: Too many concurrent requests.")
+				logf(r.Context(), "Request rejected: %d concurrent requests already in flight", limit)
+				return
+			}
+			defer func() { <-slots }()
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// acquireSlot takes a slot from slots, waiting up to wait in wait mode. It
+// gives up early if the client goes away.
+func acquireSlot(r *http.Request, slots chan struct{}, mode string, wait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if mode != "wait" {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// hostLimiter caps the requests in flight to each target host, so one busy
+// host can't take every upstream connection. Each host gets its own
+// semaphore, created on first use and dropped as soon as nobody holds or
+// waits for one of its slots, so the map only ever holds active hosts.
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	mode  string
+	wait  time.Duration
+	hosts map[string]*hostSlots
+}
+
+// hostSlots is one host's semaphore and the number of requests holding or
+// waiting for a slot in it.
+type hostSlots struct {
+	slots chan struct{}
+	users int
+}
+
+// hostLimit is built in main when max-per-host is set; nil disables it.
+var hostLimit *hostLimiter
+
+func newHostLimiter(limit int, mode string, wait time.Duration) *hostLimiter {
+	return &hostLimiter{
+		limit: limit,
+		mode:  mode,
+		wait:  wait,
+		hosts: make(map[string]*hostSlots),
+	}
+}
+
+// acquire takes one of host's slots for r, waiting as acquireSlot does. A
+// successful call must be paired with release.
+func (l *hostLimiter) acquire(r *http.Request, host string) bool {
+	l.mu.Lock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{slots: make(chan struct{}, l.limit)}
+		l.hosts[host] = h
+	}
+	h.users++
+	l.mu.Unlock()
+
+	if !acquireSlot(r, h.slots, l.mode, l.wait) {
+		l.leave(host, h)
+		return false
+	}
+	return true
+}
+
+// release gives back a slot taken by acquire.
+func (l *hostLimiter) release(host string) {
+	l.mu.Lock()
+	h := l.hosts[host]
+	l.mu.Unlock()
+	<-h.slots
+	l.leave(host, h)
+}
+
+// leave drops h from the map once its last user is gone.
+func (l *hostLimiter) leave(host string, h *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h.users--; h.users == 0 {
+		delete(l.hosts, host)
+	}
+}
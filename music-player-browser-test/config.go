@@ -0,0 +1,649 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the proxy. It can be populated from a YAML
+// or JSON file (keys are the flag names), from PROXY_ environment variables
+// and from command-line flags; see LoadConfig for the precedence.
+type Config struct {
+	ConfigFile   string   `yaml:"-"`
+	ValidateOnly bool     `yaml:"-"`
+	Args         []string `yaml:"-"` // command-line arguments after the flags
+
+	// Server
+	Addr            string        `yaml:"addr"`
+	Unix            string        `yaml:"unix"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	DrainDelay      time.Duration `yaml:"drain-delay"`
+	ReadyCanary     string        `yaml:"ready-canary"`
+	MaxHeaderBytes  int           `yaml:"max-header-bytes"`
+	TLSCert         string        `yaml:"tls-cert"`
+	TLSKey          string        `yaml:"tls-key"`
+	ClientCA        string        `yaml:"client-ca"`
+	LogFormat       string        `yaml:"log-format"`
+	ErrorFormat     string        `yaml:"error-format"`
+	PprofAddr       string        `yaml:"pprof-addr"`
+	SlowThreshold   time.Duration `yaml:"slow-threshold"`
+	Debug           bool          `yaml:"debug"`
+
+	// Access log: written with the other logs unless given a file
+	AccessLog         string `yaml:"access-log"`
+	AccessLogMaxSize  int64  `yaml:"access-log-max-size"`
+	AccessLogMaxFiles int    `yaml:"access-log-max-files"`
+
+	AutocertDomains  []string `yaml:"autocert-domains"`
+	AutocertCacheDir string   `yaml:"autocert-cache"`
+
+	// CORS: the default policy, and per-path rules (config file only)
+	CORSPolicy `yaml:",inline"`
+	CORSRules  []CORSRule `yaml:"cors-rules"`
+
+	// Authentication
+	BasicAuthUser string   `yaml:"basic-auth-user"`
+	BasicAuthPass string   `yaml:"basic-auth-pass"`
+	APIKeys       []string `yaml:"api-keys"`
+
+	// Opening hours
+	AllowedHours string `yaml:"allowed-hours"`
+	Timezone     string `yaml:"timezone"`
+
+	// Target policy
+	AllowHosts        []string `yaml:"allow-hosts"`
+	BlockHosts        []string `yaml:"block-hosts"`
+	AllowPrivate      bool     `yaml:"allow-private"`
+	AllowSchemes      []string `yaml:"allow-schemes"`
+	AllowPorts        []string `yaml:"allow-ports"`
+	AllowContentTypes []string `yaml:"allow-content-types"`
+	MaxBody           int64    `yaml:"max-body"`
+	BaseURL           string   `yaml:"base-url"`
+
+	// Target rewriting: the rules are config file only
+	RewriteRules []RewriteRule `yaml:"rewrite-rules"`
+	RewriteAll   bool          `yaml:"rewrite-all"`
+
+	// Upstream client
+	MaxIdleConns          int           `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max-idle-conns-per-host"`
+	MaxConnsPerHost       int           `yaml:"max-conns-per-host"`
+	IdleConnTimeout       time.Duration `yaml:"idle-conn-timeout"`
+	Timeout               time.Duration `yaml:"timeout"`
+	MaxTimeout            time.Duration `yaml:"max-timeout"`
+	DialTimeout           time.Duration `yaml:"dial-timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response-header-timeout"`
+	DNSCacheTTL           time.Duration `yaml:"dns-cache-ttl"`
+	DNSServer             string        `yaml:"dns-server"`
+	UpstreamProxy         string        `yaml:"upstream-proxy"`
+	UpstreamClientCert    string        `yaml:"upstream-client-cert"`
+	UpstreamClientKey     string        `yaml:"upstream-client-key"`
+	UpstreamCA            string        `yaml:"upstream-ca"`
+	UpstreamCASystem      bool          `yaml:"upstream-ca-system"`
+	InsecureSkipVerify    bool          `yaml:"insecure-skip-verify"`
+	DisableHTTP2          bool          `yaml:"disable-http2"`
+	WSUpgradeTimeout      time.Duration `yaml:"ws-upgrade-timeout"`
+	FollowRedirects       bool          `yaml:"follow-redirects"`
+	MaxRedirects          int           `yaml:"max-redirects"`
+	Retries               int           `yaml:"retries"`
+	RetryBackoff          time.Duration `yaml:"retry-backoff"`
+	ForwardHeaders        []string      `yaml:"forward-headers"`
+	UserAgent             string        `yaml:"user-agent"`
+	PassUserAgent         bool          `yaml:"pass-user-agent"`
+	PreserveHost          bool          `yaml:"preserve-host"`
+	Forwarded             bool          `yaml:"forwarded"`
+
+	// Load management
+	Rate              float64       `yaml:"rate"`
+	Burst             int           `yaml:"burst"`
+	TrustForwardedFor bool          `yaml:"trust-forwarded-for"`
+	TrustedProxies    []ipPrefix    `yaml:"trusted-proxies"`
+	MaxConcurrent     int           `yaml:"max-concurrent"`
+	MaxConcurrentMode string        `yaml:"max-concurrent-mode"`
+	MaxConcurrentWait time.Duration `yaml:"max-concurrent-wait"`
+	MaxPerHost        int           `yaml:"max-per-host"`
+	BreakerFailures   int           `yaml:"breaker-failures"`
+	BreakerWindow     time.Duration `yaml:"breaker-window"`
+	BreakerCooldown   time.Duration `yaml:"breaker-cooldown"`
+
+	// Responses
+	CacheTTL       time.Duration `yaml:"cache-ttl"`
+	CacheMaxBytes  int64         `yaml:"cache-max-bytes"`
+	CacheDir       string        `yaml:"cache-dir"`
+	ServeStale     time.Duration `yaml:"serve-stale-on-error"`
+	Prefetch       []string      `yaml:"prefetch"`
+	Compress       bool          `yaml:"compress"`
+	CacheControl   string        `yaml:"cache-control"`
+	CopyBufferSize int           `yaml:"copy-buffer-size"`
+	ByteRate       int64         `yaml:"rate-limit-bytes"`
+	ServerTiming   bool          `yaml:"server-timing"`
+	JSONP          bool          `yaml:"jsonp"`
+
+	StripResponseHeaders []string `yaml:"strip-response-headers"`
+	KeepResponseHeaders  []string `yaml:"keep-response-headers"`
+	RewriteCookieDomain  bool     `yaml:"rewrite-cookie-domain"`
+
+	// Batch endpoint
+	BatchWorkers  int   `yaml:"batch-workers"`
+	BatchMaxItems int   `yaml:"batch-max-items"`
+	BatchMaxBody  int64 `yaml:"batch-max-body"`
+
+	// Metrics
+	DurationBuckets []float64 `yaml:"duration-buckets"`
+}
+
+// liveConfig holds the configuration in effect. main stores the loaded one
+// and a SIGHUP reload swaps in its replacement; the defaults keep handlers
+// usable before that, e.g. in tests.
+var liveConfig atomic.Pointer[Config]
+
+func init() { liveConfig.Store(defaultConfig()) }
+
+// cfg returns the configuration in effect. A reload may land between two
+// calls, so a Config is never modified once stored; build a new one instead.
+func cfg() *Config { return liveConfig.Load() }
+
+// defaultConfig returns the settings used when nothing else is supplied.
+func defaultConfig() *Config {
+	return &Config{
+		Addr:            ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		MaxHeaderBytes:  http.DefaultMaxHeaderBytes,
+		LogFormat:       "text",
+		ErrorFormat:     "text",
+
+		AccessLogMaxSize:  100 << 20,
+		AccessLogMaxFiles: 5,
+
+		AutocertCacheDir: "autocert-cache",
+
+		CORSPolicy: CORSPolicy{
+			AllowMethods:  []string{"GET", "HEAD", "OPTIONS"},
+			ExposeHeaders: []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag"},
+		},
+
+		AllowSchemes: []string{"http", "https"},
+
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		MaxTimeout:            2 * time.Minute,
+		DialTimeout:           10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		WSUpgradeTimeout:      10 * time.Second,
+		FollowRedirects:       true,
+		MaxRedirects:          10,
+		Forwarded:             true,
+		RetryBackoff:          200 * time.Millisecond,
+
+		Burst:             10,
+		MaxConcurrentMode: "reject",
+		MaxConcurrentWait: 2 * time.Second,
+		BreakerWindow:     30 * time.Second,
+		BreakerCooldown:   30 * time.Second,
+
+		CacheMaxBytes:  64 << 20,
+		CopyBufferSize: 32 << 10,
+
+		BatchWorkers:  4,
+		BatchMaxItems: 32,
+		BatchMaxBody:  1 << 20,
+
+		DurationBuckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}
+}
+
+// newFlagSet binds a flag for every setting to the fields of c. Each flag's
+// default is the field's current value.
+func (c *Config) newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [serve] [flags]\n       %s check [flags] <url>\n\n", fs.Name(), fs.Name())
+		fmt.Fprintf(fs.Output(), "serve runs the proxy and is the default; check fetches <url> once through\nthe same target policy and prints the response status and headers.\n\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set with a %s environment variable, e.g. -max-body as %s.\n", envPrefix, envName("max-body"))
+	}
+
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "YAML or JSON config file; environment variables and flags override its values")
+	fs.BoolVar(&c.ValidateOnly, "validate", c.ValidateOnly, "check the configuration, report any problems and exit without serving")
+
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on (overrides $PORT)")
+	fs.StringVar(&c.Unix, "unix", c.Unix, "listen on this Unix domain socket path instead of -addr")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "grace period for in-flight requests to finish on SIGINT/SIGTERM")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "on SIGINT/SIGTERM, report not ready on /readyz for this long before refusing new connections")
+	fs.StringVar(&c.ReadyCanary, "ready-canary", c.ReadyCanary, "upstream URL /readyz must be able to reach, checked at most every 10s (empty skips the check)")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "largest request header block the server reads; bigger requests get 431")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file; serve HTTPS when set together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file; serve HTTPS when set together with -tls-cert")
+	fs.StringVar(&c.ClientCA, "client-ca", c.ClientCA, "PEM bundle of CAs that client certificates must chain to; with -tls-cert, connections without a valid one are refused")
+	fs.Var(listValue{&c.AutocertDomains}, "autocert-domains", "comma-separated domains to get Let's Encrypt certificates for; serves HTTPS on :443 and redirects :80")
+	fs.StringVar(&c.AutocertCacheDir, "autocert-cache", c.AutocertCacheDir, "directory where -autocert-domains certificates are cached")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output format: text or json")
+	fs.StringVar(&c.PprofAddr, "pprof-addr", c.PprofAddr, "serve net/http/pprof on this separate address, e.g. localhost:6060 (empty disables)")
+	fs.DurationVar(&c.SlowThreshold, "slow-threshold", c.SlowThreshold, "log a WARN line for proxied requests taking longer than this (0 disables)")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "log the headers of every upstream request and response (verbose; credentials are redacted)")
+	fs.StringVar(&c.AccessLog, "access-log", c.AccessLog, "write access log records to this file instead of stderr, in -log-format")
+	fs.Int64Var(&c.AccessLogMaxSize, "access-log-max-size", c.AccessLogMaxSize, "rotate -access-log before it grows past this many bytes (0 never rotates)")
+	fs.IntVar(&c.AccessLogMaxFiles, "access-log-max-files", c.AccessLogMaxFiles, "number of rotated -access-log files to keep")
+	fs.StringVar(&c.ErrorFormat, "error-format", c.ErrorFormat, `body of proxy-generated errors: text, or json for {"error":"...","code":...}`)
+
+	fs.Var(listValue{&c.Origins}, "origins", "comma-separated list of allowed CORS origins, e.g. https://app.com,*.app.com (empty allows any origin)")
+	fs.IntVar(&c.PreflightMaxAge, "preflight-max-age", c.PreflightMaxAge, "seconds browsers may cache a preflight response (0 omits Access-Control-Max-Age)")
+	fs.Var(listValue{&c.AllowMethods}, "allow-methods", "comma-separated methods clients may use through the proxy")
+	fs.Var(listValue{&c.ExposeHeaders}, "expose-headers", "comma-separated response headers browser scripts may read (Access-Control-Expose-Headers)")
+	fs.BoolVar(&c.AllowCredentials, "allow-credentials", c.AllowCredentials, "send Access-Control-Allow-Credentials for allowed origins (requires -origins)")
+
+	fs.StringVar(&c.BasicAuthUser, "basic-auth-user", c.BasicAuthUser, "require HTTP Basic credentials with this user name (empty disables)")
+	fs.StringVar(&c.BasicAuthPass, "basic-auth-pass", c.BasicAuthPass, "password for -basic-auth-user")
+	fs.Var(listValue{&c.APIKeys}, "api-keys", "comma-separated API keys accepted in X-Api-Key or ?api_key= (empty disables); list several to rotate")
+	fs.StringVar(&c.AllowedHours, "allowed-hours", c.AllowedHours, "only proxy during this time of day, e.g. 08:00-18:00 or 22:00-06:00 (empty is always open)")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "IANA time zone for -allowed-hours, e.g. Europe/Berlin (empty uses the server's local time)")
+
+	fs.Var(listValue{&c.AllowHosts}, "allow-hosts", "comma-separated list of permitted target hosts, e.g. cdn.example.com,*.example.org (empty allows any host)")
+	fs.Var(listValue{&c.BlockHosts}, "block-hosts", "comma-separated list of target hosts to refuse, in the same form as -allow-hosts; wins over -allow-hosts")
+	fs.BoolVar(&c.AllowPrivate, "allow-private", c.AllowPrivate, "allow targets that resolve to loopback, link-local or private addresses (for local testing)")
+	fs.Var(listValue{&c.AllowSchemes}, "allow-schemes", "comma-separated target URL schemes the proxy will fetch")
+	fs.Var(listValue{&c.AllowPorts}, "allow-ports", "comma-separated target ports the proxy will connect to, e.g. 80,443; a URL without a port uses its scheme's default (empty allows any)")
+	fs.StringVar(&c.BaseURL, "base-url", c.BaseURL, "resolve relative targets such as ?target=/songs/1.mp3 against this URL, e.g. https://cdn.example.com")
+	fs.BoolVar(&c.RewriteAll, "rewrite-all", c.RewriteAll, "apply every matching rewrite-rules entry in turn instead of only the first")
+	fs.Var(listValue{&c.AllowContentTypes}, "allow-content-types", "comma-separated upstream Content-Types to relay, e.g. audio/*,application/json (empty allows any)")
+	fs.Int64Var(&c.MaxBody, "max-body", c.MaxBody, "maximum upstream response body size in bytes (0 means unlimited)")
+
+	fs.IntVar(&c.MaxIdleConns, "max-idle-conns", c.MaxIdleConns, "maximum idle upstream connections kept across all hosts")
+	fs.IntVar(&c.MaxIdleConnsPerHost, "max-idle-conns-per-host", c.MaxIdleConnsPerHost, "maximum idle upstream connections kept per host")
+	fs.IntVar(&c.MaxConnsPerHost, "max-conns-per-host", c.MaxConnsPerHost, "maximum upstream connections per host, idle or in use (0 means unlimited); further requests wait for one")
+	fs.DurationVar(&c.IdleConnTimeout, "idle-conn-timeout", c.IdleConnTimeout, "close idle upstream connections after this long (0 keeps them open)")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "overall timeout for an upstream fetch, including the body and retries (0 means no limit)")
+	fs.DurationVar(&c.MaxTimeout, "max-timeout", c.MaxTimeout, "cap on the per-request ?timeout= override (0 means no cap)")
+	fs.DurationVar(&c.DialTimeout, "dial-timeout", c.DialTimeout, "timeout for establishing an upstream connection")
+	fs.DurationVar(&c.ResponseHeaderTimeout, "response-header-timeout", c.ResponseHeaderTimeout, "timeout waiting for upstream response headers")
+	fs.DurationVar(&c.DNSCacheTTL, "dns-cache-ttl", c.DNSCacheTTL, "cache resolved target host addresses for this long (0 disables); failures are cached for at most 5s")
+	fs.StringVar(&c.DNSServer, "dns-server", c.DNSServer, "resolve target hosts with this DNS server, as host or host:port (port 53 by default), instead of the system resolver")
+	fs.BoolVar(&c.DisableHTTP2, "disable-http2", c.DisableHTTP2, "speak only HTTP/1.1 to upstreams instead of negotiating HTTP/2 over TLS")
+	fs.StringVar(&c.UpstreamProxy, "upstream-proxy", c.UpstreamProxy, "send upstream requests through this http://, https:// or socks5:// proxy (empty connects directly)")
+	fs.StringVar(&c.UpstreamClientCert, "upstream-client-cert", c.UpstreamClientCert, "certificate file to present to upstreams that ask for one; set together with -upstream-client-key")
+	fs.StringVar(&c.UpstreamClientKey, "upstream-client-key", c.UpstreamClientKey, "private key file for -upstream-client-cert")
+	fs.StringVar(&c.UpstreamCA, "upstream-ca", c.UpstreamCA, "PEM bundle of CAs to verify upstream certificates against instead of the system roots")
+	fs.BoolVar(&c.UpstreamCASystem, "upstream-ca-system", c.UpstreamCASystem, "trust the system roots as well as -upstream-ca")
+	fs.BoolVar(&c.InsecureSkipVerify, "insecure-skip-verify", c.InsecureSkipVerify, "accept any upstream TLS certificate; for local testing against self-signed origins only")
+	fs.DurationVar(&c.WSUpgradeTimeout, "ws-upgrade-timeout", c.WSUpgradeTimeout, "timeout for connecting to a /ws target and completing its handshake")
+	fs.BoolVar(&c.FollowRedirects, "follow-redirects", c.FollowRedirects, "follow upstream redirects instead of relaying the 3xx to the client")
+	fs.IntVar(&c.MaxRedirects, "max-redirects", c.MaxRedirects, "redirects to follow before giving up with 508 Loop Detected")
+	fs.IntVar(&c.Retries, "retries", c.Retries, "retry idempotent (GET/HEAD) upstream requests this many times on network errors and 5xx responses")
+	fs.DurationVar(&c.RetryBackoff, "retry-backoff", c.RetryBackoff, "delay before the first retry; doubles on each further attempt")
+	fs.Var(listValue{&c.ForwardHeaders}, "forward-headers", "comma-separated client request headers to copy to the upstream, e.g. Authorization,If-None-Match")
+	fs.StringVar(&c.UserAgent, "user-agent", c.UserAgent, "User-Agent to send upstream (empty keeps Go's default)")
+	fs.BoolVar(&c.PassUserAgent, "pass-user-agent", c.PassUserAgent, "send the client's own User-Agent upstream, falling back to -user-agent")
+	fs.BoolVar(&c.PreserveHost, "preserve-host", c.PreserveHost, "send the client's Host header upstream instead of the target's host")
+	fs.BoolVar(&c.Forwarded, "forwarded", c.Forwarded, "tell the upstream the client's IP with X-Forwarded-For and Forwarded (false hides it)")
+
+	fs.Float64Var(&c.Rate, "rate", c.Rate, "requests per second allowed per client IP (0 disables rate limiting)")
+	fs.IntVar(&c.Burst, "burst", c.Burst, "maximum burst size per client IP when -rate is set")
+	fs.BoolVar(&c.TrustForwardedFor, "trust-forwarded-for", c.TrustForwardedFor, "trust X-Forwarded-For from any peer, like -trusted-proxies 0.0.0.0/0,::/0")
+	fs.Var(prefixListValue{&c.TrustedProxies}, "trusted-proxies", "comma-separated IPs or CIDRs of proxies in front of this one whose X-Forwarded-For identifies the client")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", c.MaxConcurrent, "maximum proxied requests in flight at once (0 means unlimited)")
+	fs.StringVar(&c.MaxConcurrentMode, "max-concurrent-mode", c.MaxConcurrentMode, "what to do when -max-concurrent is reached: reject (503 immediately) or wait")
+	fs.DurationVar(&c.MaxConcurrentWait, "max-concurrent-wait", c.MaxConcurrentWait, "how long a request may wait for a slot in wait mode before getting 503")
+	fs.IntVar(&c.MaxPerHost, "max-per-host", c.MaxPerHost, "maximum upstream requests in flight to any one target host (0 means unlimited); follows -max-concurrent-mode and -max-concurrent-wait")
+	fs.IntVar(&c.BreakerFailures, "breaker-failures", c.BreakerFailures, "consecutive failures within -breaker-window that open a host's circuit breaker (0 disables)")
+	fs.DurationVar(&c.BreakerWindow, "breaker-window", c.BreakerWindow, "window in which -breaker-failures must occur to open the circuit")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", c.BreakerCooldown, "how long an open circuit rejects requests before letting a probe through")
+
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "cache successful GET responses in memory for this long (0 disables caching)")
+	fs.Int64Var(&c.CacheMaxBytes, "cache-max-bytes", c.CacheMaxBytes, "maximum total body bytes held by the response cache")
+	fs.StringVar(&c.CacheDir, "cache-dir", c.CacheDir, "keep cached bodies as files in this directory rather than in memory, so hits are served with sendfile (empty keeps them in memory)")
+	fs.DurationVar(&c.ServeStale, "serve-stale-on-error", c.ServeStale, "when the upstream fails, serve a cached copy that expired at most this long ago instead of an error (0 disables)")
+	fs.Var(listValue{&c.Prefetch}, "prefetch", "comma-separated target URLs to fetch into the cache at startup and keep warm (needs -cache-ttl)")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "gzip compressible responses (text, JSON, XML) for clients that accept it")
+	fs.StringVar(&c.CacheControl, "cache-control", c.CacheControl, "Cache-Control header to set on successful responses, e.g. \"public, max-age=86400\" (empty relays the upstream's)")
+	fs.IntVar(&c.CopyBufferSize, "copy-buffer-size", c.CopyBufferSize, "bytes read from the upstream per chunk; each chunk is flushed to the client")
+	fs.IntVar(&c.CopyBufferSize, "copy-buffer", c.CopyBufferSize, "alias for -copy-buffer-size")
+	fs.Int64Var(&c.ByteRate, "rate-limit-bytes", c.ByteRate, "cap each relayed response at this many bytes per second (0 means unlimited)")
+	fs.BoolVar(&c.JSONP, "jsonp", c.JSONP, "wrap JSON responses as callback(...) for ?target= requests with ?callback=; such responses bypass CORS, so use with care")
+	fs.BoolVar(&c.ServerTiming, "server-timing", c.ServerTiming, "report the upstream's time to first byte in a Server-Timing header")
+	fs.Var(listValue{&c.StripResponseHeaders}, "strip-response-headers", "comma-separated upstream response headers to drop, e.g. Server,X-Powered-By,Set-Cookie")
+	fs.Var(listValue{&c.KeepResponseHeaders}, "keep-response-headers", "comma-separated allowlist of upstream response headers to relay; body framing headers are always kept (empty relays all)")
+	fs.BoolVar(&c.RewriteCookieDomain, "rewrite-cookie-domain", c.RewriteCookieDomain, "drop the Domain attribute of relayed Set-Cookie headers so browsers store the cookies for the proxy's host")
+
+	fs.IntVar(&c.BatchWorkers, "batch-workers", c.BatchWorkers, "number of targets a /batch request fetches concurrently")
+	fs.IntVar(&c.BatchMaxItems, "batch-max-items", c.BatchMaxItems, "maximum number of targets in one /batch request")
+	fs.Int64Var(&c.BatchMaxBody, "batch-max-body", c.BatchMaxBody, "maximum body size in bytes of each /batch item")
+
+	fs.Var(floatListValue{&c.DurationBuckets}, "duration-buckets", "comma-separated upper bounds, in seconds, of the proxy_upstream_duration_seconds histogram")
+
+	return fs
+}
+
+// envPrefix is prepended to a flag's name, upper-cased with dashes turned
+// into underscores, to get its environment variable: -max-body is
+// PROXY_MAX_BODY.
+const envPrefix = "PROXY_"
+
+// LoadConfig resolves the configuration from, in increasing precedence, the
+// defaults, the -config file, the environment and the command-line flags in
+// args. lookupEnv is normally os.LookupEnv. $PORT is honoured for platforms
+// that set it, below PROXY_ADDR.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	// The file has to be read before the environment and flags are applied
+	// on top of it, so do a first pass just to find out which file that is
+	first := defaultConfig()
+	fs := first.newFlagSet()
+	if err := applyEnv(fs, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if first.ConfigFile != "" {
+		if err := c.loadFile(first.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	if port, ok := lookupEnv("PORT"); ok && port != "" {
+		c.Addr = ":" + port
+	}
+
+	fs = c.newFlagSet()
+	fs.SetOutput(io.Discard) // the first pass already reported any errors
+	if err := applyEnv(fs, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.Args = fs.Args()
+	return c, nil
+}
+
+// applyEnv sets every flag in fs that has a PROXY_ environment variable.
+func applyEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", value, name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// envName returns the environment variable for the flag called name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadFile decodes the YAML or JSON file at path into c. JSON is accepted
+// because it is valid YAML. Keys c doesn't know about are an error.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %v", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration for values that are malformed or that
+// can't be used together.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if err := validateListenAddr(c.Addr); err != nil {
+		errs = append(errs, err)
+	}
+	if c.PprofAddr != "" {
+		if err := validateListenAddr(c.PprofAddr); err != nil {
+			errs = append(errs, fmt.Errorf("pprof-addr: %v", err))
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	if c.ClientCA != "" && c.TLSCert == "" && len(c.AutocertDomains) == 0 {
+		errs = append(errs, errors.New("client-ca requires TLS serving; set tls-cert and tls-key"))
+	}
+	if len(c.AutocertDomains) > 0 {
+		if c.TLSCert != "" || c.TLSKey != "" {
+			errs = append(errs, errors.New("autocert-domains cannot be combined with tls-cert/tls-key"))
+		}
+		if c.Unix != "" {
+			errs = append(errs, errors.New("autocert-domains cannot be combined with unix"))
+		}
+		// Let's Encrypt's TLS-ALPN-01 validator presents no client
+		// certificate, so requiring one would stop issuance and renewal
+		if c.ClientCA != "" {
+			errs = append(errs, errors.New("autocert-domains cannot be combined with client-ca; use tls-cert/tls-key"))
+		}
+		if c.AutocertCacheDir == "" {
+			errs = append(errs, errors.New("autocert-cache must be set with autocert-domains"))
+		}
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("unknown log-format %q (want text or json)", c.LogFormat))
+	}
+	if c.AccessLogMaxSize < 0 {
+		errs = append(errs, errors.New("access-log-max-size must not be negative"))
+	}
+	if c.AccessLogMaxFiles < 0 {
+		errs = append(errs, errors.New("access-log-max-files must not be negative"))
+	}
+	if c.ErrorFormat != "text" && c.ErrorFormat != "json" {
+		errs = append(errs, fmt.Errorf("unknown error-format %q (want text or json)", c.ErrorFormat))
+	}
+	errs = append(errs, c.CORSPolicy.validate(""))
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || !u.IsAbs() || u.Host == "" {
+			errs = append(errs, fmt.Errorf("base-url %q must be an absolute URL", c.BaseURL))
+		}
+	}
+	for i, rule := range c.RewriteRules {
+		if rule.Match.Regexp == nil {
+			errs = append(errs, fmt.Errorf("rewrite-rules[%d]: match is required", i))
+		}
+	}
+	for _, rule := range c.CORSRules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			errs = append(errs, fmt.Errorf("cors-rules: path %q must start with /", rule.Path))
+		}
+		errs = append(errs, rule.inherit(&c.CORSPolicy).validate("cors-rules "+rule.Path+": "))
+	}
+	if c.BasicAuthPass != "" && c.BasicAuthUser == "" {
+		errs = append(errs, errors.New("basic-auth-pass requires basic-auth-user"))
+	}
+	if c.MaxConcurrentMode != "reject" && c.MaxConcurrentMode != "wait" {
+		errs = append(errs, fmt.Errorf("unknown max-concurrent-mode %q (want reject or wait)", c.MaxConcurrentMode))
+	}
+	if c.MaxPerHost < 0 {
+		errs = append(errs, errors.New("max-per-host must not be negative"))
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		errs = append(errs, errors.New("max-idle-conns, max-idle-conns-per-host and max-conns-per-host must not be negative"))
+	}
+	if c.IdleConnTimeout < 0 {
+		errs = append(errs, errors.New("idle-conn-timeout must not be negative"))
+	}
+	if c.WSUpgradeTimeout <= 0 {
+		errs = append(errs, errors.New("ws-upgrade-timeout must be positive"))
+	}
+	if c.DNSServer != "" {
+		if _, err := dnsServerAddr(c.DNSServer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.UpstreamProxy != "" {
+		if _, err := parseUpstreamProxy(c.UpstreamProxy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if (c.UpstreamClientCert == "") != (c.UpstreamClientKey == "") {
+		errs = append(errs, errors.New("upstream-client-cert and upstream-client-key must be set together"))
+	} else if _, err := upstreamTLSConfig(c); err != nil {
+		errs = append(errs, err)
+	}
+	if c.UpstreamCASystem && c.UpstreamCA == "" {
+		errs = append(errs, errors.New("upstream-ca-system requires upstream-ca"))
+	}
+	for _, port := range c.AllowPorts {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("allow-ports: %q is not a port number", port))
+		}
+	}
+	if c.AllowedHours != "" {
+		if _, err := parseHourWindow(c.AllowedHours, c.Timezone); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.MaxRedirects < 1 {
+		errs = append(errs, errors.New("max-redirects must be at least 1; use -follow-redirects=false to relay redirects"))
+	}
+	if c.Timeout < 0 || c.MaxTimeout < 0 {
+		errs = append(errs, errors.New("timeout and max-timeout must not be negative"))
+	}
+	if c.Rate < 0 {
+		errs = append(errs, errors.New("rate must not be negative"))
+	}
+	if c.Rate > 0 && c.Burst < 1 {
+		errs = append(errs, errors.New("burst must be at least 1 when rate is set"))
+	}
+	if len(c.StripResponseHeaders) > 0 && len(c.KeepResponseHeaders) > 0 {
+		errs = append(errs, errors.New("strip-response-headers and keep-response-headers cannot be combined"))
+	}
+	if c.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("max-header-bytes must be positive"))
+	}
+	if c.DrainDelay < 0 {
+		errs = append(errs, errors.New("drain-delay must not be negative"))
+	}
+	if c.ReadyCanary != "" {
+		if u, err := url.Parse(c.ReadyCanary); err != nil || !u.IsAbs() || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ready-canary %q must be an absolute URL", c.ReadyCanary))
+		}
+	}
+	if c.SlowThreshold < 0 {
+		errs = append(errs, errors.New("slow-threshold must not be negative"))
+	}
+	if c.ByteRate < 0 {
+		errs = append(errs, errors.New("rate-limit-bytes must not be negative"))
+	}
+	if len(c.Prefetch) > 0 && c.CacheTTL <= 0 {
+		errs = append(errs, errors.New("prefetch needs the cache; set cache-ttl"))
+	}
+	if c.CacheDir != "" && c.CacheTTL <= 0 {
+		errs = append(errs, errors.New("cache-dir needs the cache; set cache-ttl"))
+	}
+	if c.ServeStale < 0 {
+		errs = append(errs, errors.New("serve-stale-on-error must not be negative"))
+	} else if c.ServeStale > 0 && c.CacheTTL <= 0 {
+		errs = append(errs, errors.New("serve-stale-on-error needs the cache; set cache-ttl"))
+	}
+	if c.CopyBufferSize < 1 {
+		errs = append(errs, errors.New("copy-buffer-size must be at least 1"))
+	}
+	if c.BreakerFailures < 0 {
+		errs = append(errs, errors.New("breaker-failures must not be negative"))
+	}
+	if c.BreakerFailures > 0 && (c.BreakerWindow <= 0 || c.BreakerCooldown <= 0) {
+		errs = append(errs, errors.New("breaker-window and breaker-cooldown must be positive when breaker-failures is set"))
+	}
+	if len(c.DurationBuckets) == 0 {
+		errs = append(errs, errors.New("duration-buckets needs at least one bucket"))
+	}
+	for i := 1; i < len(c.DurationBuckets); i++ {
+		if c.DurationBuckets[i] <= c.DurationBuckets[i-1] {
+			errs = append(errs, errors.New("duration-buckets must be strictly increasing"))
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateListenAddr checks that addr is a host:port with a valid port.
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("addr %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("addr %q: port must be a number between 0 and 65535", addr)
+	}
+	return nil
+}
+
+// listValue is a flag.Value for a comma-separated list of strings.
+type listValue struct{ list *[]string }
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(s string) error {
+	*v.list = splitList(s)
+	return nil
+}
+
+// floatListValue is a flag.Value for a comma-separated list of numbers.
+type floatListValue struct{ list *[]float64 }
+
+func (v floatListValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	parts := make([]string, len(*v.list))
+	for i, f := range *v.list {
+		parts[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (v floatListValue) Set(s string) error {
+	var list []float64
+	for _, item := range splitList(s) {
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", item)
+		}
+		list = append(list, f)
+	}
+	*v.list = list
+	return nil
+}
+
+// splitList splits a comma-separated flag value, trimming blanks and dropping
+// empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyBufferSizeSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte("copy-buffer-size: 4096\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := func(name, value string) func(string) (string, bool) {
+		return func(key string) (string, bool) {
+			if key == name {
+				return value, true
+			}
+			return "", false
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  func(string) (string, bool)
+		want int
+	}{
+		{"default", nil, noEnv, 32 << 10},
+		{"flag", []string{"-copy-buffer-size", "65536"}, noEnv, 65536},
+		{"alias", []string{"-copy-buffer", "8192"}, noEnv, 8192},
+		{"environment", nil, env("PROXY_COPY_BUFFER_SIZE", "16384"), 16384},
+		{"file", []string{"-config", path}, noEnv, 4096},
+	} {
+		c, err := LoadConfig(tc.args, tc.env)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if c.CopyBufferSize != tc.want {
+			t.Errorf("%s: copy-buffer-size = %d, want %d", tc.name, c.CopyBufferSize, tc.want)
+		}
+	}
+}
+
+func TestValidateClientCA(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		ok     bool
+	}{
+		{"with tls-cert", func(c *Config) { c.TLSCert, c.TLSKey = "cert.pem", "key.pem" }, true},
+		{"without TLS", func(c *Config) {}, false},
+		{"with autocert-domains", func(c *Config) { c.AutocertDomains = []string{"proxy.example.com"} }, false},
+	} {
+		c := defaultConfig()
+		c.ClientCA = "ca.pem"
+		tc.change(c)
+		if err := c.Validate(); (err == nil) != tc.ok {
+			t.Errorf("client-ca %s: Validate() = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy is the set of CORS settings applied to a request.
+type CORSPolicy struct {
+	Origins          []string `yaml:"origins"`
+	PreflightMaxAge  int      `yaml:"preflight-max-age"`
+	AllowMethods     []string `yaml:"allow-methods"`
+	ExposeHeaders    []string `yaml:"expose-headers"`
+	AllowCredentials bool     `yaml:"allow-credentials"`
+}
+
+// CORSRule applies its own policy to requests whose path starts with Path.
+// Settings the rule leaves out are taken from the default policy, except
+// allow-credentials, which is off unless the rule turns it on.
+type CORSRule struct {
+	Path       string `yaml:"path"`
+	CORSPolicy `yaml:",inline"`
+}
+
+// inherit returns the rule's policy with omitted settings filled in from def.
+func (rule CORSRule) inherit(def *CORSPolicy) *CORSPolicy {
+	p := rule.CORSPolicy
+	if p.Origins == nil {
+		p.Origins = def.Origins
+	}
+	if p.PreflightMaxAge == 0 {
+		p.PreflightMaxAge = def.PreflightMaxAge
+	}
+	if p.AllowMethods == nil {
+		p.AllowMethods = def.AllowMethods
+	}
+	if p.ExposeHeaders == nil {
+		p.ExposeHeaders = def.ExposeHeaders
+	}
+	return &p
+}
+
+// validate checks that credentials are only granted to explicit origins.
+// Errors are prefixed with where, to tell rules apart.
+func (p *CORSPolicy) validate(where string) error {
+	var errs []error
+	for _, o := range p.Origins {
+		if err := validateOrigin(o); err != nil {
+			errs = append(errs, errors.New(where+err.Error()))
+		}
+	}
+	if err := errors.Join(errs...); err != nil || !p.AllowCredentials {
+		return err
+	}
+	if len(p.Origins) == 0 {
+		return errors.New(where + "allow-credentials requires an explicit origins allowlist")
+	}
+	for _, o := range p.Origins {
+		if o == "*" {
+			return errors.New(where + `allow-credentials cannot be combined with a "*" origin`)
+		}
+	}
+	return nil
+}
+
+// corsPolicyFor returns the policy for a request to path: the rule with the
+// longest matching path prefix, or the default policy if none matches.
+func corsPolicyFor(path string) *CORSPolicy {
+	best := -1
+	for i, rule := range cfg().CORSRules {
+		if strings.HasPrefix(path, rule.Path) && (best < 0 || len(rule.Path) > len(cfg().CORSRules[best].Path)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return &cfg().CORSPolicy
+	}
+	return cfg().CORSRules[best].inherit(&cfg().CORSPolicy)
+}
+
+// setCORSHeaders writes the CORS response headers for r.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	p := corsPolicyFor(r.URL.Path)
+	if len(p.Origins) == 0 {
+		// This allows access from any origin (e.g., http://127.0.0.1:5500)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// The answer depends on the request's Origin, so caches must key on it
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && p.allowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			// Credentials are only ever granted alongside a specific, allowed origin
+			if p.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Api-Key")
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowMethods, ", "))
+	if len(p.ExposeHeaders) > 0 {
+		// Without this, scripts can't read e.g. Content-Range to drive seeking
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+	}
+}
+
+// setPreflightHeaders adds the headers that only apply to OPTIONS preflight
+// responses.
+func setPreflightHeaders(w http.ResponseWriter, r *http.Request) {
+	if p := corsPolicyFor(r.URL.Path); p.PreflightMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.PreflightMaxAge))
+	}
+}
+
+// allowsMethod reports whether method is in the policy's list.
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	for _, m := range p.AllowMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin reports whether origin matches an entry of the policy's
+// allowlist.
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, o := range p.Origins {
+		if originMatches(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOrigin checks that an origins entry is "*", a wildcard as
+// originMatches understands it or a plain origin such as https://app.com.
+// Browsers send bare origins, so an entry with a path or without a scheme
+// would silently never match.
+func validateOrigin(pattern string) error {
+	if pattern == "*" {
+		return nil
+	}
+	wildcard := pattern
+	if _, rest, ok := strings.Cut(pattern, "://"); ok {
+		wildcard = rest
+	}
+	if domain, ok := strings.CutPrefix(wildcard, "*."); ok {
+		if domain == "" || strings.ContainsAny(domain, "/*?#@ ") {
+			return fmt.Errorf("origins: malformed wildcard %q", pattern)
+		}
+		return nil
+	}
+	u, err := url.Parse(pattern)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("origins: %q is not an origin such as https://app.com", pattern)
+	}
+	return nil
+}
+
+// originMatches reports whether origin matches the allowlist entry pattern.
+// "*" matches every origin, the same as an empty allowlist, and other
+// plain entries must equal the origin. An entry like *.app.com matches any
+// single-level subdomain (a.app.com but not a.b.app.com, app.com or
+// evil-app.com) over http or https; a scheme prefix (https://*.app.com)
+// restricts it to that scheme, and a port suffix (*.app.com:8443) is
+// required of the origin just like the absence of one is.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	scheme, wildcard, hasScheme := strings.Cut(pattern, "://")
+	if !hasScheme {
+		scheme, wildcard = "", pattern
+	}
+	domain, ok := strings.CutPrefix(wildcard, "*.")
+	if !ok {
+		return pattern == origin
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return false
+	}
+	if scheme != "" && !strings.EqualFold(u.Scheme, scheme) {
+		return false
+	}
+	if scheme == "" && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	domainHost, domainPort := domain, ""
+	if h, p, err := net.SplitHostPort(domain); err == nil {
+		domainHost, domainPort = h, p
+	}
+	if u.Port() != domainPort {
+		return false
+	}
+	sub, ok := strings.CutSuffix(strings.ToLower(u.Hostname()), "."+strings.ToLower(domainHost))
+	return ok && sub != "" && !strings.Contains(sub, ".")
+}
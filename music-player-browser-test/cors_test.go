@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDisallowedMethodIsRejectedBeforeUpstream(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AllowMethods = []string{"GET", "HEAD", "OPTIONS"} })
+	up := &upstreamCalls{next: func(w http.ResponseWriter, r *http.Request) {}}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest(http.MethodDelete, "/?target="+url.QueryEscape(srv.URL), nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, want 405", rec.Code)
+	}
+	if got := rec.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Errorf("Allow = %q", got)
+	}
+	if up.n != 0 {
+		t.Errorf("upstream was asked %d times, want 0", up.n)
+	}
+
+	rec = proxyGet(srv.URL, nil)
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, HEAD, OPTIONS" {
+		t.Errorf("Access-Control-Allow-Methods on an actual response = %q", got)
+	}
+}
+
+func TestOriginMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"*", "https://a.com", true},
+		{"*", "http://localhost:5500", true},
+		{"https://a.com", "https://a.com", true},
+		{"https://a.com", "http://a.com", false},
+		{"*.app.com", "https://a.app.com", true},
+		{"*.app.com", "http://b.app.com", true},
+		{"*.app.com", "https://app.com", false},
+		{"*.app.com", "https://evil-app.com", false},
+		{"*.app.com", "https://x.evil-app.com", false},
+		{"*.app.com", "https://a.b.app.com", false},
+		{"*.app.com", "https://a.app.com.evil.com", false},
+		{"*.app.com", "https://a.app.com:8443", false},
+		{"*.app.com:8443", "https://a.app.com:8443", true},
+		{"*.app.com:8443", "https://a.app.com", false},
+		{"https://*.app.com", "http://a.app.com", false},
+		{"https://*.app.com", "https://A.App.com", true},
+		{"*.app.com", "ftp://a.app.com", false},
+		{"*.app.com", "https://user@a.app.com", false},
+		{"*.app.com", "null", false},
+	} {
+		if got := originMatches(tc.pattern, tc.origin); got != tc.want {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tc.pattern, tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestRedirectHopsCannotSetCORSHeaders(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.FollowRedirects = true
+		c.Origins = []string{"https://app.example"}
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://evil.example")
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		default:
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	rec := proxyGet(srv.URL+"/a", http.Header{"Origin": {"https://app.example"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if v := rec.Header().Values("Access-Control-Allow-Origin"); len(v) != 1 || v[0] != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want only the proxy's own", v)
+	}
+	if v := rec.Header().Values("Access-Control-Allow-Credentials"); len(v) != 0 {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want the upstream's dropped", v)
+	}
+}
+
+func TestStarOriginAllowsEveryBrowser(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Origins = []string{"*"} })
+	if err := cfg().Validate(); err != nil {
+		t.Fatalf("Validate rejected origins \"*\": %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	rec := proxyGet(srv.URL, http.Header{"Origin": {"https://app.example"}})
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the request's origin", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// scrubbedHeaders carry credentials. Their values are replaced in -debug
+// dumps so turning on debugging never writes secrets to the log.
+var scrubbedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// debugTransport logs the headers of every upstream request and response
+// that passes through next, including each redirect hop and retry. Bodies
+// are never dumped.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	scrubHeaders(out.Header)
+	if dump, err := httputil.DumpRequestOut(out, false); err == nil {
+		logf(req.Context(), "Upstream request:\n%s", strings.TrimSpace(string(dump)))
+	} else {
+		logf(req.Context(), "Could not dump upstream request: %v", err)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		logf(req.Context(), "Upstream request to %s failed: %v", req.URL, err)
+		return resp, err
+	}
+
+	// Dump a shallow copy so scrubbing doesn't touch what the client gets
+	shown := *resp
+	shown.Header = resp.Header.Clone()
+	scrubHeaders(shown.Header)
+	if dump, err := httputil.DumpResponse(&shown, false); err == nil {
+		logf(req.Context(), "Upstream response:\n%s", strings.TrimSpace(string(dump)))
+	} else {
+		logf(req.Context(), "Could not dump upstream response: %v", err)
+	}
+	return resp, nil
+}
+
+// scrubHeaders replaces the values of scrubbedHeaders in h.
+func scrubHeaders(h http.Header) {
+	for _, name := range scrubbedHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			h.Set(name, "[REDACTED]")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolver resolves target hosts for both the SSRF check and the dialer.
+// main replaces it with one for -dns-server when that is set.
+var resolver = net.DefaultResolver
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr instead of the ones in resolv.conf.
+func newResolver(addr string) *net.Resolver {
+	var dialer net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// dnsServerAddr turns a -dns-server value into a host:port address,
+// defaulting to port 53.
+func dnsServerAddr(server string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+	addr := net.JoinHostPort(server, "53")
+	if _, _, err := net.SplitHostPort(addr); err != nil || server == "" {
+		return "", fmt.Errorf("dns-server %q: want host or host:port", server)
+	}
+	return addr, nil
+}
+
+// dnsNegativeTTL caps how long a failed lookup is remembered, so a host
+// that was briefly unresolvable recovers quickly.
+const dnsNegativeTTL = 5 * time.Second
+
+// dnsCacheMaxEntries is the size at which expired entries are swept out.
+const dnsCacheMaxEntries = 1024
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// hostCache remembers resolved addresses per host name for ttl, and failed
+// lookups for at most dnsNegativeTTL. The SSRF check and the dialer both
+// resolve through it, so they also agree on which addresses a host has.
+type hostCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+}
+
+// dnsCache is built in main when dns-cache-ttl is set; nil disables caching.
+var dnsCache *hostCache
+
+func newHostCache(ttl time.Duration) *hostCache {
+	return &hostCache{ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+// lookup returns host's addresses from the cache, resolving it on a miss.
+// Concurrent misses for the same host may each resolve it; the last answer
+// wins, which is harmless.
+func (c *hostCache) lookup(ctx context.Context, host string, now time.Time) ([]net.IP, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip", host)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// Our own deadline, not an answer about the host
+		return nil, err
+	}
+	ttl := c.ttl
+	if err != nil {
+		ttl = min(ttl, dnsNegativeTTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheMaxEntries {
+		for h, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, h)
+			}
+		}
+	}
+	c.entries[host] = dnsEntry{ips: ips, err: err, expires: now.Add(ttl)}
+	return ips, err
+}
+
+// lookupIP resolves host, through dnsCache when it is enabled. IP literals
+// are returned as they are.
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if dnsCache == nil {
+		return resolver.LookupIP(ctx, "ip", host)
+	}
+	return dnsCache.lookup(ctx, host, time.Now())
+}
+
+// errPrivateAddress is returned by the dialer when, with -allow-private off,
+// a target host resolves to an internal address at connection time.
+var errPrivateAddress = errors.New("target resolves to a private address")
+
+// cachedDialContext wraps dial so host names are resolved with lookupIP, then
+// tries each address in turn until one connects. Unless -allow-private is
+// set, the addresses actually dialed are checked again here: checkTarget
+// resolved the host separately, and a DNS answer that changed in between
+// (rebinding) must not reach an internal service. exempt is the upstream
+// proxy's address, if any, which is dialed in place of every target and may
+// well be internal.
+func cachedDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), exempt string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if !cfg().AllowPrivate && addr != exempt {
+			for _, ip := range ips {
+				if !isPublicIP(ip) {
+					return nil, fmt.Errorf("%w: %s resolved to %s when connecting", errPrivateAddress, host, ip)
+				}
+			}
+		}
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		return nil, lastErr
+	}
+}
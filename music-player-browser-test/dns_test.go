@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDialRejectsPrivateAddresses(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AllowPrivate = false })
+	var dialed []string
+	fakeDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	dial := cachedDialContext(fakeDial, "10.0.0.9:3128")
+
+	for _, addr := range []string{"127.0.0.1:80", "10.1.2.3:443", "[::1]:80", "169.254.169.254:80"} {
+		if _, err := dial(context.Background(), "tcp", addr); !errors.Is(err, errPrivateAddress) {
+			t.Errorf("dialing %s: got %v, want errPrivateAddress", addr, err)
+		}
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("private addresses were dialed: %v", dialed)
+	}
+
+	for _, addr := range []string{"8.8.8.8:53", "10.0.0.9:3128"} {
+		conn, err := dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Errorf("dialing %s: %v", addr, err)
+			continue
+		}
+		conn.Close()
+	}
+	if len(dialed) != 2 {
+		t.Errorf("dialed %v, want the public address and the upstream proxy", dialed)
+	}
+
+	cfg().AllowPrivate = true
+	if _, err := dial(context.Background(), "tcp", "127.0.0.1:80"); err != nil {
+		t.Errorf("with -allow-private, dialing loopback failed: %v", err)
+	}
+}
+
+// fakeDNS serves DNS over UDP, answering every A query with ip and every
+// other query with no records. It returns its address and a count of the
+// queries it received.
+func fakeDNS(t *testing.T, ip net.IP) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	queries := new(atomic.Int32)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			q := buf[:n]
+			// The question's name starts after the 12 byte header and is
+			// followed by its type and class
+			end := 12
+			for end < n && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			if end+5 > n {
+				continue
+			}
+			isA := q[end+1] == 0 && q[end+2] == 1
+			end += 5
+
+			resp := append([]byte{}, q[:2]...)    // ID
+			resp = append(resp, 0x81, 0x80, 0, 1) // response, recursion available; 1 question
+			if isA {
+				resp = append(resp, 0, 1, 0, 0, 0, 0)
+			} else {
+				resp = append(resp, 0, 0, 0, 0, 0, 0)
+			}
+			resp = append(resp, q[12:end]...)
+			if isA {
+				// Name pointer to the question, type A, class IN, TTL 60, 4 bytes
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), queries
+}
+
+func TestDNSServerIsUsedForChecksAndDialing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via " + r.Host))
+	}))
+	defer srv.Close()
+	prev := resolver
+	defer func() { resolver = prev }()
+
+	// The SSRF check resolves through -dns-server
+	addr, queries := fakeDNS(t, net.IPv4(10, 0, 0, 7))
+	resolver = newResolver(addr)
+	ips, err := lookupIP(context.Background(), "music.example")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("lookupIP = %v, %v; want 10.0.0.7 from the fake server", ips, err)
+	}
+	if public, err := isPublicAddress("music.example"); err != nil || public {
+		t.Errorf("isPublicAddress = %v, %v; want the private answer rejected", public, err)
+	}
+	if queries.Load() == 0 {
+		t.Error("the fake DNS server was never asked")
+	}
+
+	// So does the dialer
+	withConfig(t, nil)
+	addr, _ = fakeDNS(t, net.IPv4(127, 0, 0, 1))
+	resolver = newResolver(addr)
+	target := strings.Replace(srv.URL, "127.0.0.1", "music.example", 1)
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(target), nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "via music.example") {
+		t.Errorf("got %d %q, want the test server reached as music.example", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDNSServerAddr(t *testing.T) {
+	for in, want := range map[string]string{"10.0.0.1": "10.0.0.1:53", "10.0.0.1:5353": "10.0.0.1:5353", "::1": "[::1]:53"} {
+		if got, err := dnsServerAddr(in); err != nil || got != want {
+			t.Errorf("dnsServerAddr(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := dnsServerAddr(""); err == nil {
+		t.Error("dnsServerAddr accepted an empty server")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorBody is the -error-format=json body of a proxy-generated error.
+type errorBody struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError replies to a request the proxy itself refuses or fails, as plain
+// text like http.Error or, with -error-format=json, as an errorBody. Every
+// proxy-generated error goes through here so the format is the same for all.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	if cfg().ErrorFormat != "json" {
+		http.Error(w, msg, status)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: msg, Code: status})
+}
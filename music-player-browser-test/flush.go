@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// flushWriter flushes the response after every write, so each chunk copied
+// from the upstream reaches the client straight away instead of waiting in
+// the server's output buffer. Writers that can't flush are written to as
+// they are.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	ok bool
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w), ok: true}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil && f.ok {
+		if ferr := f.rc.Flush(); errors.Is(ferr, http.ErrNotSupported) {
+			f.ok = false
+		}
+	}
+	return n, err
+}
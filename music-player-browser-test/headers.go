@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hopByHopHeaders only describe a single connection and must never be
+// relayed across the proxy (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHopByHop reports whether name is a hop-by-hop header for a message whose
+// headers are h, including any headers h's Connection field nominates.
+func isHopByHop(h http.Header, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, hop := range hopByHopHeaders {
+		if name == hop {
+			return true
+		}
+	}
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(token)) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, including any
+// named in its Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Del(token)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// isAllowedContentType reports whether an upstream Content-Type may be
+// relayed. Patterns are full media types or "type/*"; parameters such as
+// charset are ignored. With no allowlist configured everything is allowed.
+func isAllowedContentType(contentType string) bool {
+	if len(cfg().AllowContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cfg().AllowContentTypes {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// setUserAgent picks the User-Agent for the upstream request out from the
+// client request r. With neither option set, Go's default is left in place.
+func setUserAgent(out, r *http.Request) {
+	if ua := r.Header.Get("User-Agent"); cfg().PassUserAgent && ua != "" {
+		out.Header.Set("User-Agent", ua)
+		return
+	}
+	if cfg().UserAgent != "" {
+		out.Header.Set("User-Agent", cfg().UserAgent)
+	}
+}
+
+// setHost makes the upstream request's Host the target's own, so
+// virtual-hosted origins see the name they serve whatever the client sent.
+// With -preserve-host the client's Host is kept instead.
+func setHost(out, r *http.Request) {
+	out.Header.Del("Host")
+	if cfg().PreserveHost {
+		out.Host = r.Host
+		return
+	}
+	out.Host = out.URL.Host
+}
+
+// setForwarded appends the peer's IP to the X-Forwarded-For and Forwarded
+// chains of the upstream request. A chain started by earlier proxies is only
+// continued when the peer is a trusted proxy; otherwise the client may have
+// forged it and it is dropped. Nothing is sent with -forwarded=false.
+func setForwarded(out, r *http.Request) {
+	if !cfg().Forwarded {
+		return
+	}
+	ip := peerIP(r)
+	trusted := isTrustedProxy(ip)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	xff := ip
+	if prior := strings.Join(r.Header.Values("X-Forwarded-For"), ", "); trusted && prior != "" {
+		xff = prior + ", " + ip
+	}
+	out.Header.Set("X-Forwarded-For", xff)
+
+	// RFC 7239: IPv6 addresses are bracketed, which makes the value a quoted string
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = `"[` + ip + `]"`
+	}
+	fwd := "for=" + node + ";proto=" + proto
+	if r.Host != "" {
+		fwd += `;host="` + r.Host + `"`
+	}
+	if prior := strings.Join(r.Header.Values("Forwarded"), ", "); trusted && prior != "" {
+		fwd = prior + ", " + fwd
+	}
+	out.Header.Set("Forwarded", fwd)
+}
+
+// copyForwardHeaders copies the allowlisted headers from the client request
+// header src to the upstream request header dst, skipping hop-by-hop ones.
+func copyForwardHeaders(dst, src http.Header, allow []string) {
+	for _, name := range allow {
+		if isHopByHop(src, name) {
+			continue
+		}
+		for _, value := range src.Values(name) {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// credentialHeaders are the request headers that identify a user to the
+// upstream; a response to a request carrying one may be personal.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// forwardsCredentials reports whether r has a credential header that
+// -forward-headers would pass on to the upstream.
+func forwardsCredentials(r *http.Request) bool {
+	for _, name := range cfg().ForwardHeaders {
+		if r.Header.Get(name) != "" && containsFold(credentialHeaders, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideCacheControl replaces the upstream Cache-Control with -cache-control
+// on successful responses, so the browser caches media as configured rather
+// than as the CDN says. Errors keep their own header; a cached 404 would
+// outlive the problem.
+func overrideCacheControl(h http.Header, status int) {
+	if cfg().CacheControl == "" {
+		return
+	}
+	if status < 200 || status >= 300 && status != http.StatusNotModified {
+		return
+	}
+	h.Set("Cache-Control", cfg().CacheControl)
+}
+
+// setServerTiming reports how long the upstream took to start responding as
+// an "upstream" Server-Timing metric when -server-timing is on. Browsers only
+// show cross-origin timings to pages that Timing-Allow-Origin admits, so the
+// origin CORS has already let in is admitted too.
+func setServerTiming(h http.Header, upstream time.Duration) {
+	if !cfg().ServerTiming {
+		return
+	}
+	h.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f", float64(upstream.Microseconds())/1000))
+	if origin := h.Get("Access-Control-Allow-Origin"); origin != "" {
+		h.Set("Timing-Allow-Origin", origin)
+	}
+}
+
+// cleanResponseHeaders applies the proxy's response header policy to the
+// upstream response header h in place: hop-by-hop headers go, then
+// -strip-response-headers/-keep-response-headers and -rewrite-cookie-domain
+// are applied.
+func cleanResponseHeaders(h http.Header) {
+	removeHopByHopHeaders(h)
+	filterResponseHeaders(h, cfg().StripResponseHeaders, cfg().KeepResponseHeaders)
+	if cfg().RewriteCookieDomain {
+		stripCookieDomains(h)
+	}
+}
+
+// stripCookieDomains removes the Domain attribute from every Set-Cookie in h.
+// A Domain naming the upstream is rejected by browsers on the proxy's
+// responses; without one the cookie is stored for the proxy's own host.
+// Every other attribute, Path and Secure included, is kept verbatim.
+func stripCookieDomains(h http.Header) {
+	values := h.Values("Set-Cookie")
+	for i, value := range values {
+		parts := strings.Split(value, ";")
+		kept := parts[:1]
+		for _, attr := range parts[1:] {
+			name, _, _ := strings.Cut(attr, "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "Domain") {
+				kept = append(kept, attr)
+			}
+		}
+		values[i] = strings.Join(kept, ";")
+	}
+}
+
+// framingHeaders describe how the body is encoded and which part of it is
+// sent. Dropping them would leave the client unable to read the body, so
+// filterResponseHeaders never does.
+var framingHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range"}
+
+// filterResponseHeaders removes the strip headers from upstream response
+// header h or, when keep is non-empty, every header not in keep apart from
+// framingHeaders. Names are matched case-insensitively.
+func filterResponseHeaders(h http.Header, strip, keep []string) {
+	for _, name := range strip {
+		h.Del(name)
+	}
+	if len(keep) == 0 {
+		return
+	}
+	for name := range h {
+		if !containsFold(keep, name) && !containsFold(framingHeaders, name) {
+			delete(h, name)
+		}
+	}
+}
+
+// containsFold reports whether list contains name, ignoring case.
+func containsFold(list []string, name string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardHeadersAllowlist(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ForwardHeaders = []string{"Authorization", "Keep-Alive"} })
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	proxyGet(srv.URL, http.Header{
+		"Authorization": {"Bearer token"},
+		"X-Secret":      {"s"},
+		"Keep-Alive":    {"timeout=5"},
+	})
+	if v := got.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("Authorization = %q, want it forwarded", v)
+	}
+	if v := got.Get("X-Secret"); v != "" {
+		t.Errorf("X-Secret = %q, want it dropped", v)
+	}
+	if v := got.Get("Keep-Alive"); v != "" {
+		t.Errorf("hop-by-hop Keep-Alive = %q, want it dropped even when listed", v)
+	}
+}
+
+func TestForwardedCredentialsBypassTheCache(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ForwardHeaders = []string{"Authorization", "Cookie"} })
+	withCache(t, newResponseCache(time.Minute, 0, 1<<20))
+	up := &upstreamCalls{next: func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("for " + r.Header.Get("Authorization")))
+	}}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	for _, user := range []string{"alice", "bob"} {
+		rec := proxyGet(srv.URL, http.Header{"Authorization": {user}})
+		if rec.Body.String() != "for "+user {
+			t.Errorf("%s got %q", user, rec.Body.String())
+		}
+	}
+	if up.n != 2 {
+		t.Errorf("upstream was asked %d times, want 2", up.n)
+	}
+	if n := cache.stats().Entries; n != 0 {
+		t.Errorf("cache holds %d entries for credentialed requests, want 0", n)
+	}
+}
+
+func TestHopByHopResponseHeadersAreStripped(t *testing.T) {
+	withConfig(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Foo")
+		w.Header().Set("X-Foo", "1")
+		w.Header().Set("X-Bar", "1")
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush() // forces a chunked response
+		w.Write([]byte("y"))
+	}))
+	defer srv.Close()
+
+	rec := proxyGet(srv.URL, nil)
+	if rec.Body.String() != "xy" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+	for _, name := range []string{"Transfer-Encoding", "Connection", "X-Foo"} {
+		if v := rec.Header().Get(name); v != "" {
+			t.Errorf("%s = %q, want it stripped", name, v)
+		}
+	}
+	if v := rec.Header().Get("X-Bar"); v != "1" {
+		t.Errorf("X-Bar = %q, want the end-to-end header relayed", v)
+	}
+
+	h := http.Header{"Transfer-Encoding": {"chunked"}, "Keep-Alive": {"timeout=5"}, "Content-Type": {"audio/mpeg"}}
+	removeHopByHopHeaders(h)
+	if len(h) != 1 || h.Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("removeHopByHopHeaders left %v", h)
+	}
+}
+
+func TestAllowContentTypes(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AllowContentTypes = []string{"audio/*", "application/json"} })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+	withType := func(ct string) string { return srv.URL + "/?ct=" + url.QueryEscape(ct) }
+
+	for ct, want := range map[string]int{
+		"text/html":                       http.StatusUnsupportedMediaType,
+		"audio/mpeg":                      http.StatusOK,
+		"application/json; charset=utf-8": http.StatusOK,
+	} {
+		rec := proxyGet(withType(ct), nil)
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", ct, rec.Code, want)
+		}
+		if want != http.StatusOK && rec.Body.String() == "body" {
+			t.Errorf("%s: the rejected body was relayed", ct)
+		}
+	}
+
+	_, results := postBatch(t, withType("text/html"), withType("audio/mpeg"))
+	if len(results) != 2 {
+		t.Fatalf("got %d batch results, want 2", len(results))
+	}
+	if results[0].Error == "" || results[0].Body != "" {
+		t.Errorf("text/html batch item: %+v, want an error and no body", results[0])
+	}
+	if results[1].Error != "" || results[1].Body != "body" {
+		t.Errorf("audio/mpeg batch item: %+v", results[1])
+	}
+}
+
+func TestHostHeaderFollowsTarget(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ForwardHeaders = []string{"Host"} })
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { host = r.Host }))
+	defer srv.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(srv.URL), nil)
+	req.Host = "proxy.example"
+	req.Header.Set("Host", "proxy.example")
+	proxyHandler(httptest.NewRecorder(), req)
+	if want := strings.TrimPrefix(srv.URL, "http://"); host != want {
+		t.Errorf("upstream saw Host %q, want the target's %q", host, want)
+	}
+
+	cfg().PreserveHost = true
+	proxyHandler(httptest.NewRecorder(), req)
+	if host != "proxy.example" {
+		t.Errorf("with -preserve-host the upstream saw Host %q, want proxy.example", host)
+	}
+}
+
+func TestStripCookieDomains(t *testing.T) {
+	h := http.Header{}
+	h.Add("Set-Cookie", "sid=abc; Domain=.upstream.example; Path=/api; Secure; HttpOnly")
+	h.Add("Set-Cookie", "x=1;domain=upstream.example")
+	h.Add("Set-Cookie", "y=2; Path=/")
+	stripCookieDomains(h)
+
+	want := []string{"sid=abc; Path=/api; Secure; HttpOnly", "x=1", "y=2; Path=/"}
+	got := h.Values("Set-Cookie")
+	if len(got) != len(want) {
+		t.Fatalf("Set-Cookie = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Set-Cookie[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+	c, err := http.ParseSetCookie(got[0])
+	if err != nil || c.Domain != "" || c.Path != "/api" || !c.Secure || !c.HttpOnly {
+		t.Errorf("rewritten cookie parses as %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthHandler answers liveness checks from load balancers and Kubernetes.
+// It never contacts an upstream, so it stays green even when targets are down.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// canaryTTL is how long a -ready-canary result is reused, so frequent
+// /readyz probes don't each hit the canary.
+const canaryTTL = 10 * time.Second
+
+// readiness tracks whether the proxy should be sent traffic.
+type readiness struct {
+	// serving is set once the listener is up and cleared when shutdown
+	// begins, before the server stops accepting
+	serving atomic.Bool
+
+	mu        sync.Mutex
+	checked   time.Time
+	canaryErr error
+}
+
+var ready readiness
+
+// canary fetches -ready-canary, reusing the last result for canaryTTL. Any
+// response below 500 counts as the upstream being reachable.
+func (rd *readiness) canary(now time.Time) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && now.Sub(rd.checked) < canaryTTL {
+		return rd.canaryErr
+	}
+
+	// Not tied to the probe's request, so one impatient probe can't cache a failure
+	ctx, cancel := withTimeout(context.Background(), cfg().Timeout)
+	defer cancel()
+	rd.canaryErr = nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg().ReadyCanary, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				err = fmt.Errorf("canary answered %s", resp.Status)
+			}
+		}
+	}
+	rd.canaryErr, rd.checked = err, now
+	return err
+}
+
+// livezHandler answers liveness probes: 200 for as long as the process serves.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	healthHandler(w, r)
+}
+
+// readyzHandler answers readiness probes: 200 once the server is up and,
+// with -ready-canary, the canary upstream is reachable; 503 otherwise and as
+// soon as shutdown begins, so load balancers drain the instance.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status, reason := http.StatusOK, ""
+	if !ready.serving.Load() {
+		status, reason = http.StatusServiceUnavailable, "not serving"
+	} else if cfg().ReadyCanary != "" {
+		if err := ready.canary(time.Now()); err != nil {
+			status, reason = http.StatusServiceUnavailable, "canary unreachable"
+			logf(r.Context(), "Readiness check failed: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		w.Write([]byte(`{"status":"ok"}` + "\n"))
+		return
+	}
+	fmt.Fprintf(w, `{"status":"unavailable","reason":%q}`+"\n", reason)
+}
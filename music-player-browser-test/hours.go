@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hourWindow is the -allowed-hours part of the day, in minutes since
+// midnight in loc. A window whose end is before its start wraps past
+// midnight, so "22:00-06:00" covers the night.
+type hourWindow struct {
+	start, end int
+	loc        *time.Location
+}
+
+// openHours is built in main when -allowed-hours is set; nil keeps the proxy
+// open around the clock.
+var openHours *hourWindow
+
+// parseHourWindow parses an "HH:MM-HH:MM" window. An empty timezone means
+// the server's local time.
+func parseHourWindow(s, timezone string) (*hourWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("allowed-hours %q is not of the form HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, fmt.Errorf("allowed-hours %q: %v", s, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, fmt.Errorf("allowed-hours %q: %v", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("allowed-hours %q is empty", s)
+	}
+	// LoadLocation("") would mean UTC, not the local time
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	return &hourWindow{start: start, end: end, loc: loc}, nil
+}
+
+// parseClock parses an HH:MM time of day into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// allows reports whether now falls inside the window. The start minute is
+// included, the end minute is not.
+func (w *hourWindow) allows(now time.Time) bool {
+	local := now.In(w.loc)
+	minute := local.Hour()*60 + local.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// checkOpenHours refuses r with 403 outside -allowed-hours and reports
+// whether it may go on.
+func checkOpenHours(w http.ResponseWriter, r *http.Request) bool {
+	if openHours == nil || openHours.allows(time.Now()) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "Forbidden: The proxy is closed outside its allowed hours.")
+	metrics.clientErrors.Add(1)
+	logf(r.Context(), "Request rejected: outside -allowed-hours")
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHourWindowAllows(t *testing.T) {
+	day, err := parseHourWindow("08:00-18:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	night, err := parseHourWindow("22:00-06:30", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(h, m int) time.Time { return time.Date(2024, 1, 1, h, m, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		w    *hourWindow
+		now  time.Time
+		want bool
+	}{
+		{day, at(8, 0), true},
+		{day, at(17, 59), true},
+		{day, at(18, 0), false},
+		{day, at(3, 0), false},
+		{night, at(23, 0), true},
+		{night, at(0, 0), true},
+		{night, at(6, 29), true},
+		{night, at(6, 30), false},
+		{night, at(12, 0), false},
+	} {
+		if got := tc.w.allows(tc.now); got != tc.want {
+			t.Errorf("%02d:%02d-%02d:%02d allows %s = %v, want %v", tc.w.start/60, tc.w.start%60,
+				tc.w.end/60, tc.w.end%60, tc.now.Format("15:04"), got, tc.want)
+		}
+	}
+
+	// 07:30 UTC on 1 January is 08:30 in Berlin
+	berlin, err := parseHourWindow("08:00-09:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !berlin.allows(at(7, 30)) {
+		t.Error("the window was not read in its timezone")
+	}
+
+	local, err := parseHourWindow("08:00-09:00", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.loc != time.Local {
+		t.Errorf("an empty timezone gave %v, want the local time", local.loc)
+	}
+
+	for _, bad := range []string{"8-9", "08:00", "08:00-08:00", "25:00-01:00"} {
+		if _, err := parseHourWindow(bad, ""); err == nil {
+			t.Errorf("parseHourWindow(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestClosedHoursRejectProxyRequests(t *testing.T) {
+	withConfig(t, nil)
+	now := time.Now().UTC()
+	later := (now.Hour()*60 + now.Minute() + 120) % (24 * 60)
+	prev := openHours
+	openHours = &hourWindow{start: later, end: (later + 60) % (24 * 60), loc: time.UTC}
+	defer func() { openHours = prev }()
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?target=http://example.com/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d outside the allowed hours, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "sync"
+
+// fetchGroup lets concurrent cache misses for the same response share one
+// upstream fetch. The first request to join a key leads: it relays the
+// response to its own client and fills the cache. The others wait only
+// until the leader knows whether the response is being stored, then read it
+// from the cache or fetch it themselves.
+type fetchGroup struct {
+	mu      sync.Mutex
+	pending map[string]*pendingFetch
+}
+
+// pendingFetch is one shared fetch. done is closed by release, after which
+// stored tells whether the response can be read from the cache.
+type pendingFetch struct {
+	group  *fetchGroup
+	key    string
+	once   sync.Once
+	done   chan struct{}
+	stored bool
+}
+
+// inflight deduplicates concurrent cacheable fetches, keyed like the cache.
+var inflight = &fetchGroup{pending: make(map[string]*pendingFetch)}
+
+// join returns the pending fetch for key, starting one if there is none,
+// and whether the caller leads it. A leader must call release.
+func (g *fetchGroup) join(key string) (*pendingFetch, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.pending[key]; ok {
+		return f, false
+	}
+	f := &pendingFetch{group: g, key: key, done: make(chan struct{})}
+	g.pending[key] = f
+	return f, true
+}
+
+// release wakes the fetch's followers, telling them whether the response
+// was stored. A request arriving afterwards starts a fetch of its own. Only
+// the first call has any effect, and a nil f is ignored, so relayUpstream
+// can release as early as it knows the outcome and the leader can release
+// again on its way out.
+func (f *pendingFetch) release(stored bool) {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.stored = stored
+		f.group.mu.Lock()
+		delete(f.group.pending, f.key)
+		f.group.mu.Unlock()
+		close(f.done)
+	})
+}
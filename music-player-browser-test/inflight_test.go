@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchGroupJoinAndRelease(t *testing.T) {
+	g := &fetchGroup{pending: make(map[string]*pendingFetch)}
+	f, leader := g.join("k")
+	if !leader {
+		t.Fatal("the first join did not lead")
+	}
+	if same, leader := g.join("k"); leader || same != f {
+		t.Fatal("a second join did not follow the pending fetch")
+	}
+	f.release(true)
+	f.release(false) // only the first release counts
+	<-f.done
+	if !f.stored {
+		t.Error("stored was overwritten by a later release")
+	}
+	if _, leader := g.join("k"); !leader {
+		t.Error("a join after release did not start a new fetch")
+	}
+	(*pendingFetch)(nil).release(true)
+}
+
+func TestConcurrentMissesShareOneFetch(t *testing.T) {
+	withConfig(t, nil)
+	withCache(t, newResponseCache(time.Minute, 0, 1<<20))
+	var hits atomic.Int32
+	arrived, unblock := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			close(arrived)
+			<-unblock
+		}
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+	target := srv.URL + "/song.mp3"
+
+	var wg sync.WaitGroup
+	fetch := func() {
+		defer wg.Done()
+		if got := proxyGet(target, nil).Body.String(); got != "audio" {
+			t.Errorf("got body %q", got)
+		}
+	}
+	wg.Add(1)
+	go fetch()
+	<-arrived
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go fetch()
+	}
+	close(unblock)
+	wg.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream was asked %d times, want 1", n)
+	}
+}
+
+func TestSharedFetchLetsFollowersGo(t *testing.T) {
+	withConfig(t, nil)
+	withCache(t, newResponseCache(time.Minute, 0, 1<<20))
+	var hits atomic.Int32
+	arrived, unblock := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nostore" {
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		if hits.Add(1) == 1 {
+			close(arrived)
+			<-unblock
+		}
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+
+	leaderDone := make(chan struct{})
+	start := func(path string) {
+		go func() {
+			proxyGet(srv.URL+path, nil)
+			leaderDone <- struct{}{}
+		}()
+		<-arrived
+	}
+	finishes := func(name string, serve func()) {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			serve()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s kept waiting on the stuck leader", name)
+		}
+	}
+
+	// The leader's response won't be stored, so a follower fetches its own
+	start("/nostore")
+	finishes("an uncacheable follower", func() {
+		if got := proxyGet(srv.URL+"/nostore", nil).Body.String(); got != "audio" {
+			t.Errorf("follower got body %q", got)
+		}
+	})
+	close(unblock)
+	<-leaderDone
+
+	// A follower whose client leaves stops waiting
+	hits.Store(0)
+	arrived, unblock = make(chan struct{}), make(chan struct{})
+	start("/song.mp3")
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(srv.URL+"/song.mp3"), nil).WithContext(ctx)
+	cancel()
+	finishes("a disconnected follower", func() { proxyHandler(httptest.NewRecorder(), req) })
+	close(unblock)
+	<-leaderDone
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// jsonpCallbackParam names the JavaScript function a -jsonp response calls.
+const jsonpCallbackParam = "callback"
+
+// jsonpCallback matches the callback names -jsonp accepts: a JavaScript
+// identifier or a dotted path of them, such as player.onData. Anything else
+// could smuggle script into the response.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]{0,63}(\.[A-Za-z_$][A-Za-z0-9_$]{0,63}){0,7}$`)
+
+// isJSONContentType reports whether contentType is a JSON media type.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// prepareJSONP readies r for a JSONP response: the body has to arrive whole
+// and unencoded to be wrapped, so the client's Accept-Encoding, Range and
+// validators are not passed on.
+func prepareJSONP(r *http.Request) {
+	for _, name := range []string{"Accept-Encoding", "Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		r.Header.Del(name)
+	}
+}
+
+// jsonpWriter wraps a successful JSON response as callback(<json>); and
+// serves it as JavaScript. A successful response of any other type is
+// replaced by a 415; errors are passed through untouched.
+type jsonpWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	callback    string
+	wroteHeader bool
+	wrapping    bool
+	discard     bool
+}
+
+func (j *jsonpWriter) WriteHeader(status int) {
+	if j.wroteHeader {
+		return
+	}
+	j.wroteHeader = true
+	if status < 200 || status >= 300 {
+		j.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	h := j.Header()
+	if !isJSONContentType(h.Get("Content-Type")) {
+		for _, name := range framingHeaders {
+			h.Del(name)
+		}
+		writeError(j.ResponseWriter, http.StatusUnsupportedMediaType, "Unsupported Media Type: JSONP needs a JSON response from the target")
+		metrics.clientErrors.Add(1)
+		logf(j.ctx, "JSONP request rejected: content type %q is not JSON", h.Get("Content-Type"))
+		j.discard = true
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/javascript; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	j.ResponseWriter.WriteHeader(status)
+	// The leading comment keeps callers from controlling the first bytes of
+	// the response, which some plugin content sniffers have abused
+	j.ResponseWriter.Write([]byte("/**/" + j.callback + "("))
+	j.wrapping = true
+}
+
+func (j *jsonpWriter) Write(p []byte) (int, error) {
+	if !j.wroteHeader {
+		j.WriteHeader(http.StatusOK)
+	}
+	if j.discard {
+		return len(p), nil
+	}
+	return j.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (j *jsonpWriter) Unwrap() http.ResponseWriter {
+	return j.ResponseWriter
+}
+
+// finish closes the callback call once the body has been written.
+func (j *jsonpWriter) finish() {
+	if j.wrapping {
+		j.ResponseWriter.Write([]byte(");"))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// unixSocketMode lets the owner and its group (e.g. nginx's) connect to the
+// -unix socket, but nobody else.
+const unixSocketMode = 0o660
+
+// listen opens the listener the server accepts connections on: the -unix
+// socket when one is configured, otherwise TCP on addr. It also returns a
+// description of where it is listening, for logs.
+func listen(addr string) (net.Listener, string, error) {
+	if cfg().Unix == "" {
+		ln, err := net.Listen("tcp", addr)
+		return ln, addr, err
+	}
+
+	// A socket left behind by a crashed run would make Listen fail with
+	// "address already in use". Anything that isn't a socket is left alone.
+	if fi, err := os.Lstat(cfg().Unix); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, "", fmt.Errorf("%s exists and is not a socket", cfg().Unix)
+		}
+		if err := os.Remove(cfg().Unix); err != nil {
+			return nil, "", fmt.Errorf("removing stale socket: %v", err)
+		}
+	}
+
+	// The listener unlinks the socket file when it is closed, which
+	// server.Shutdown does, so a graceful exit leaves nothing behind
+	ln, err := net.Listen("unix", cfg().Unix)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(cfg().Unix, unixSocketMode); err != nil {
+		ln.Close()
+		return nil, "", fmt.Errorf("setting socket permissions: %v", err)
+	}
+	return ln, "unix:" + cfg().Unix, nil
+}
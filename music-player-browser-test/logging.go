@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// setupLogging installs the slog handler for the requested format. In json
+// mode the standard log package is routed through slog as well, so every
+// line the proxy writes is a single JSON object.
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+		// The default slog handler already writes through the log package
+		return nil
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+}
+
+// accessLog is the logger for access log records when -access-log names a
+// file; nil sends them to the default logger with everything else.
+var accessLog *slog.Logger
+
+// setupAccessLog opens the -access-log file, if any, and builds accessLog to
+// write to it in the given format.
+func setupAccessLog(path string, maxSize int64, maxFiles int, format string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := openRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		accessLog = slog.New(slog.NewJSONHandler(f, nil))
+	} else {
+		accessLog = slog.New(slog.NewTextHandler(f, nil))
+	}
+	return nil
+}
+
+// requestLogger returns the default logger annotated with the request ID in
+// ctx, if any.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// logf logs a formatted message for the request that owns ctx, so the line
+// carries its request ID.
+func logf(ctx context.Context, format string, args ...any) {
+	requestLogger(ctx).Info(fmt.Sprintf(format, args...))
+}
+
+// logAccess emits the access log record for one proxied request. duration
+// covers the upstream round trip plus relaying the body.
+func logAccess(r *http.Request, target string, status int, bytes int64, duration time.Duration) {
+	logger := requestLogger(r.Context())
+	if accessLog != nil {
+		logger = accessLog
+		if id := requestIDFrom(r.Context()); id != "" {
+			logger = logger.With("request_id", id)
+		}
+	}
+	attrs := []any{
+		"client", clientIP(r),
+		"method", r.Method,
+		"target", target,
+		"status", status,
+		"bytes", bytes,
+		"duration_ms", float64(duration.Microseconds()) / 1000,
+	}
+	// With -client-ca, record who the verified client certificate names
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		attrs = append(attrs, "client_cert", r.TLS.PeerCertificates[0].Subject.String())
+	}
+	logger.Info("proxied request", attrs...)
+}
+
+// logSlow emits the extra WARN record for a request that took longer than
+// -slow-threshold.
+func logSlow(r *http.Request, status int, duration time.Duration) {
+	requestLogger(r.Context()).Warn("slow request",
+		"target", requestTarget(r),
+		"status", status,
+		"duration_ms", float64(duration.Microseconds())/1000,
+		"threshold_ms", float64(cfg().SlowThreshold.Microseconds())/1000,
+	)
+}
+
+// requestTarget returns the target r asked for, or its request URI if it
+// didn't name a valid one.
+func requestTarget(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, pathProxyPrefix) {
+		if target, err := targetFromPath(r.URL); err == nil {
+			return target
+		}
+	} else if target, err := targetFromQuery(r.URL.Query()); err == nil {
+		return target
+	}
+	return r.URL.RequestURI()
+}
@@ -1,95 +1,242 @@
 package main
 
 import (
-	"io" // Import io for copying the response body
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
-)
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-// The address where your Go server will listen (e.g., http://localhost:8080)
-const listenAddr = ":8080"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
 func main() {
-	// 1. Define a handler function for all requests ("/")
-	http.HandleFunc("/", proxyHandler)
-
-	// 2. Start the HTTP server
-	log.Printf("Starting flexible CORS proxy server on %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
-}
-
-// proxyHandler fetches the target URL specified by the 'target' query parameter.
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	// --- 1. SET CORS HEADERS ---
-	// This allows access from any origin (e.g., http://127.0.0.1:5500)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	// "serve" is the default, so plain flags keep working as before
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && (args[0] == "serve" || args[0] == "check") {
+		command, args = args[0], args[1:]
+	}
 
-	// Handle CORS preflight requests (OPTIONS method)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	loaded, err := LoadConfig(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		os.Exit(2)
+	}
+	if err := loaded.Validate(); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	if loaded.ValidateOnly {
+		fmt.Println("Configuration is valid")
+		return
+	}
+	liveConfig.Store(loaded)
 
-	// --- 2. GET TARGET URL FROM QUERY PARAMETER ---
-	// r.URL.Query() extracts the map of query parameters (e.g., "?target=...")
-	targetURL := r.URL.Query().Get("target")
+	if err := setupLogging(cfg().LogFormat); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	if err := setupAccessLog(cfg().AccessLog, cfg().AccessLogMaxSize, cfg().AccessLogMaxFiles, cfg().LogFormat); err != nil {
+		log.Printf("Error opening access log: %v", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Printf("Invalid tracing configuration: %v", err)
+		os.Exit(1)
+	}
+	if tracingEnabled {
+		log.Printf("Exporting traces over OTLP")
+	}
+	log.Printf("CORS proxy %s (commit %s, built %s)", version, commit, buildDate)
+	listenAddr := cfg().Addr
+	useTLS := cfg().TLSCert != ""
+
+	if cfg().DNSServer != "" {
+		addr, _ := dnsServerAddr(cfg().DNSServer)
+		resolver = newResolver(addr)
+		log.Printf("Resolving target hosts with DNS server %s", addr)
+	}
+	if cfg().DNSCacheTTL > 0 {
+		dnsCache = newHostCache(cfg().DNSCacheTTL)
+	}
+	client = newClient()
+	if proxyURL, _ := parseUpstreamProxy(cfg().UpstreamProxy); proxyURL != nil {
+		log.Printf("Sending upstream requests through proxy %s", proxyURL.Redacted())
+	}
+	if cfg().Debug {
+		log.Printf("Debug mode: logging upstream request and response headers")
+	}
+	if cfg().InsecureSkipVerify {
+		slog.Warn("INSECURE: -insecure-skip-verify is set, so upstream TLS certificates are not verified and " +
+			"connections to origins have no protection against man-in-the-middle attacks. Never leave this on in production.")
+	}
+	if command == "check" {
+		os.Exit(runCheck(cfg().Args))
+	}
 
-	if targetURL == "" {
-		http.Error(w, "Error: 'target' query parameter is missing.", http.StatusBadRequest)
-		log.Println("Request failed: Missing 'target' query parameter.")
-		return
+	if cfg().CacheDir != "" {
+		if cache, err = newDiskCache(cfg().CacheTTL, cfg().ServeStale, cfg().CacheMaxBytes, cfg().CacheDir); err != nil {
+			log.Printf("Error opening cache-dir: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Caching response bodies in %s", cfg().CacheDir)
+	} else if cfg().CacheTTL > 0 {
+		cache = newResponseCache(cfg().CacheTTL, cfg().ServeStale, cfg().CacheMaxBytes)
 	}
 
-	log.Printf("Proxying request to: %s", targetURL)
+	// Both proxy routes draw from the same pool of slots
+	limitConcurrency := newConcurrencyLimit(cfg().MaxConcurrent, cfg().MaxConcurrentMode, cfg().MaxConcurrentWait)
+	if cfg().MaxPerHost > 0 {
+		hostLimit = newHostLimiter(cfg().MaxPerHost, cfg().MaxConcurrentMode, cfg().MaxConcurrentWait)
+	}
 
-	// --- 3. MAKE THE REQUEST TO THE TARGET URL ---
+	if cfg().Rate > 0 {
+		limiter = newRateLimiter(cfg().Rate, cfg().Burst)
+		go limiter.runCleanup(time.Minute)
+	}
 
-	// Check if the target URL is valid
-	if _, err := url.ParseRequestURI(targetURL); err != nil {
-		http.Error(w, "Error: Invalid target URL format.", http.StatusBadRequest)
-		log.Printf("Error: Invalid target URL format: %v", err)
-		return
+	if cfg().AllowedHours != "" {
+		openHours, _ = parseHourWindow(cfg().AllowedHours, cfg().Timezone)
 	}
 
-	// Create a new request to the target audio file
-	req, err := http.NewRequest(r.Method, targetURL, nil) // Use nil for request body, as we are just forwarding a GET
-	if err != nil {
-		http.Error(w, "Internal Server Error: Failed to create request", http.StatusInternalServerError)
-		log.Printf("Error creating request: %v", err)
-		return
+	if cfg().BreakerFailures > 0 {
+		breaker = newCircuitBreaker(cfg().BreakerFailures, cfg().BreakerWindow, cfg().BreakerCooldown)
 	}
 
-	// Execute the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Internal Server Error: Failed to fetch from target URL", http.StatusInternalServerError)
-		log.Printf("Error fetching target: %v", err)
-		return
+	promMetrics = newPromCollectors(cfg().DurationBuckets)
+	promMetrics.register(prometheus.DefaultRegisterer)
+
+	// Warming runs in the background so a slow or failing target can't hold
+	// up startup. It fetches through doWithRetry, so it may only start once
+	// everything it reads (client, breaker, metrics) has been built.
+	for _, target := range cfg().Prefetch {
+		go keepWarm(target, cfg().CacheTTL)
+	}
+
+	// 1. Define a handler function for all requests ("/"). More specific
+	// routes such as /healthz are matched first and bypass the proxy. The
+	// mux is our own rather than http.DefaultServeMux, which net/http/pprof
+	// registers itself on.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/metrics.json", metricsJSONHandler)
+	mux.HandleFunc("/ws", webSocketHandler)
+	mux.HandleFunc("/cache/purge", cachePurgeHandler)
+	mux.HandleFunc("/cache/stats", cacheStatsHandler)
+	mux.Handle("/batch", withMetrics(withTracing(limitConcurrency(http.HandlerFunc(batchHandler)))))
+	mux.Handle("/", withMetrics(withTracing(limitConcurrency(http.HandlerFunc(proxyHandler)))))
+	handler := withPathTargets(mux, withMetrics(withTracing(limitConcurrency(http.HandlerFunc(pathProxyHandler)))))
+
+	// Profiling gets its own listener so it is never reachable on the public port
+	var pprofServer *http.Server
+	if cfg().PprofAddr != "" {
+		pprofServer = newPprofServer(cfg().PprofAddr)
+		go func() {
+			log.Printf("Serving pprof on %s", cfg().PprofAddr)
+			if err := pprofServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("pprof server failed: %v", err)
+			}
+		}()
 	}
-	defer resp.Body.Close() // Ensure the response body is closed
 
-	// --- 4. RELAY THE RESPONSE ---
+	// 2. Start the HTTP server in the background so we can wait for signals
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: withRequestID(withRecovery(withAuth(handler))),
+		// Oversized header blocks are refused by net/http before any handler runs
+		MaxHeaderBytes: cfg().MaxHeaderBytes,
+	}
 
-	// Copy all headers (except the original server's ACAO header)
-	for name, values := range resp.Header {
-		if name != "Access-Control-Allow-Origin" {
-			for _, value := range values {
-				w.Header().Add(name, value)
+	// With -autocert-domains, certificates come from Let's Encrypt and the
+	// standard ports are used: HTTPS on 443 and challenges/redirects on 80
+	var redirectServer *http.Server
+	if len(cfg().AutocertDomains) > 0 {
+		manager := newAutocertManager()
+		server.Addr, listenAddr, useTLS = autocertAddr, autocertAddr, true
+		server.TLSConfig = manager.TLSConfig()
+		redirectServer = newRedirectServer(manager)
+		go func() {
+			log.Printf("Serving ACME challenges and HTTPS redirects on %s", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Redirect server failed: %v", err)
 			}
-		}
+		}()
 	}
 
-	// Set the status code and copy the response body directly
-	w.WriteHeader(resp.StatusCode)
+	if cfg().ClientCA != "" {
+		if err := requireClientCerts(server, cfg().ClientCA); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		log.Printf("Requiring client certificates issued by %s", cfg().ClientCA)
+	}
 
-	// Use io.Copy for efficient streaming of the response body (the audio file)
-	_, err = io.Copy(w, resp.Body)
+	ln, where, err := listen(listenAddr)
 	if err != nil {
-		log.Printf("Error copying response body: %v", err)
+		log.Fatalf("Server failed: %v", err)
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		if useTLS {
+			log.Printf("Starting flexible CORS proxy server with TLS on %s", where)
+			serverErr <- server.ServeTLS(ln, cfg().TLSCert, cfg().TLSKey)
+			return
+		}
+		log.Printf("Starting flexible CORS proxy server on %s", where)
+		serverErr <- server.Serve(ln)
+	}()
+	ready.serving.Store(true)
+
+	// Pick up config file changes without dropping in-flight streams
+	go reloadOnHangup(args)
+
+	// 3. Drain in-flight requests on SIGINT/SIGTERM before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
 	}
 
-	log.Printf("Successfully proxied response from %s", targetURL)
+	// Fail readiness first so load balancers stop routing here while the
+	// listener still accepts whatever they send in the meantime
+	ready.serving.Store(false)
+	if cfg().DrainDelay > 0 {
+		log.Printf("Draining: reporting not ready for %s before shutting down", cfg().DrainDelay)
+		time.Sleep(cfg().DrainDelay)
+	}
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", cfg().ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg().ShutdownTimeout)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if pprofServer != nil {
+		pprofServer.Close()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v", err)
+		return
+	}
+	// Flush the spans of the requests that just finished
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
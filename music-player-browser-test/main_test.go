@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// withConfig runs a test against a copy of the default configuration that
+// may reach loopback upstreams, adjusted by change, and rebuilds the shared
+// client for it. Both are put back when the test ends.
+func withConfig(t testing.TB, change func(c *Config)) {
+	t.Helper()
+	prevConfig, prevClient := cfg(), client
+	c := defaultConfig()
+	c.AllowPrivate = true
+	if change != nil {
+		change(c)
+	}
+	liveConfig.Store(c)
+	client = newClient()
+	t.Cleanup(func() {
+		liveConfig.Store(prevConfig)
+		client = prevClient
+	})
+}
+
+// withCache installs c as the response cache for the rest of the test.
+func withCache(t *testing.T, c *responseCache) {
+	t.Helper()
+	prev := cache
+	cache = c
+	t.Cleanup(func() { cache = prev })
+}
+
+// upstreamCalls counts the requests an upstream handler receives.
+type upstreamCalls struct {
+	n    int
+	next http.HandlerFunc
+}
+
+func (u *upstreamCalls) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.n++
+	u.next(w, r)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// proxyMetrics holds the process-wide request counters, plus the active gauge
+// of proxied requests currently in flight. Fields are atomics so handlers can
+// update them concurrently without a lock.
+type proxyMetrics struct {
+	active           atomic.Int64
+	requests         atomic.Int64
+	successes        atomic.Int64
+	clientErrors     atomic.Int64
+	upstreamErrors   atomic.Int64
+	bytesTransferred atomic.Int64
+}
+
+var metrics proxyMetrics
+
+// metricsJSONHandler serves a JSON snapshot of the counters at /metrics.json
+// for simple dashboards and cron scrapers.
+func metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := map[string]int64{
+		"active_requests":         metrics.active.Load(),
+		"requests_total":          metrics.requests.Load(),
+		"successes_total":         metrics.successes.Load(),
+		"client_errors_total":     metrics.clientErrors.Load(),
+		"upstream_errors_total":   metrics.upstreamErrors.Load(),
+		"bytes_transferred_total": metrics.bytesTransferred.Load(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// countError records a proxy-generated error response: 5xx statuses are
+// blamed on the upstream, everything else on the client.
+func countError(status int) {
+	if status >= 500 {
+		metrics.upstreamErrors.Add(1)
+	} else {
+		metrics.clientErrors.Add(1)
+	}
+}
+
+// promCollectors are the Prometheus collectors exported at /metrics.
+type promCollectors struct {
+	requests         *prometheus.CounterVec
+	upstreamDuration prometheus.Histogram
+	bytesTransferred prometheus.Counter
+	activeRequests   prometheus.GaugeFunc
+}
+
+// promMetrics is rebuilt with the configured buckets and registered in main.
+var promMetrics = newPromCollectors(prometheus.DefBuckets)
+
+// newPromCollectors creates the collectors using the given histogram buckets.
+func newPromCollectors(buckets []float64) *promCollectors {
+	return &promCollectors{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Proxied requests, labeled by response status class.",
+		}, []string{"code"}),
+		upstreamDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proxy_upstream_duration_seconds",
+			Help:    "Time from sending the upstream request to finishing the relayed body.",
+			Buckets: buckets,
+		}),
+		bytesTransferred: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_bytes_transferred_total",
+			Help: "Response body bytes relayed to clients.",
+		}),
+		activeRequests: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "proxy_active_requests",
+			Help: "Proxied requests currently in flight.",
+		}, func() float64 { return float64(metrics.active.Load()) }),
+	}
+}
+
+// register adds the collectors to reg.
+func (c *promCollectors) register(reg prometheus.Registerer) {
+	reg.MustRegister(c.requests, c.upstreamDuration, c.bytesTransferred, c.activeRequests)
+}
+
+// statusClass maps a status code to its Prometheus label, e.g. 404 -> "4xx".
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
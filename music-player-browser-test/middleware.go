@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// statusRecorder wraps a ResponseWriter to remember the status code and the
+// number of body bytes written, for metrics and logging middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom hands io.Copy on to the underlying writer, so a file body can
+// still be sent with sendfile through any number of recorders.
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := io.Copy(rec.ResponseWriter, src)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// withMetrics counts every response passing through h by status class,
+// keeps the active gauge up to date while h runs and reports responses
+// slower than -slow-threshold, whether they succeeded or not.
+func withMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.active.Add(1)
+		// Deferred so panics and early returns in h still release the gauge
+		defer metrics.active.Add(-1)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		promMetrics.requests.WithLabelValues(statusClass(rec.status)).Inc()
+		if d := time.Since(start); cfg().SlowThreshold > 0 && d > cfg().SlowThreshold {
+			logSlow(r, rec.status, d)
+		}
+	})
+}
+
+// withRecovery turns a panic in h into a 500 for that one request, with the
+// stack trace logged, instead of letting it take the connection down with no
+// explanation. http.ErrAbortHandler is the deliberate way to abort a response
+// and is passed on to the server untouched.
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logf(r.Context(), "Panic serving %s: %v\n%s", r.URL.Path, p, debug.Stack())
+			metrics.upstreamErrors.Add(1)
+			if rec.status != 0 {
+				// Too late for an error response; cut the body short instead
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rec, http.StatusInternalServerError, "Internal Server Error")
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoveryAnswersAPanicWith500(t *testing.T) {
+	srv := httptest.NewServer(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/boom" {
+			var m map[string]int
+			m["x"] = 1
+		}
+		w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/boom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("panicking request: got %d, want 500", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/fine")
+	if err != nil {
+		t.Fatalf("server did not survive the panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the panic: got %d, want 200", resp.StatusCode)
+	}
+}
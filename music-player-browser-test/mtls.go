@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// requireClientCerts makes server refuse, during the TLS handshake, clients
+// that don't present a certificate chaining to one of the CAs in the PEM
+// bundle at caFile.
+func requireClientCerts(server *http.Server, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("client-ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("client-ca: no certificates found in %s", caFile)
+	}
+
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	server.TLSConfig.ClientCAs = pool
+	server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
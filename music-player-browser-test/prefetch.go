@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// prefetchRetry is how soon a failed -prefetch fetch is tried again.
+const prefetchRetry = 30 * time.Second
+
+// keepWarm fetches the -prefetch target into the cache and fetches it again
+// shortly before each copy expires, so clients never wait on the origin for
+// it. Failures are logged and retried; keepWarm runs until the process exits.
+func keepWarm(target string, ttl time.Duration) {
+	refresh := ttl * 9 / 10
+	for {
+		wait := refresh
+		if err := prefetch(target); err != nil {
+			logf(context.Background(), "Prefetch of %s failed: %v", target, err)
+			wait = min(prefetchRetry, refresh)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// prefetch GETs target through the same policy, timeout and retries as a
+// client request and stores the response in the cache. It is stored as the
+// variant for a client sending no extra headers; since no Accept-Encoding is
+// sent, the body comes back unencoded and suits every client.
+func prefetch(target string) error {
+	target = rewriteTarget(target)
+	if _, terr := checkTarget(target); terr != nil {
+		return terr.err
+	}
+
+	ctx, cancel := withTimeout(context.Background(), cfg().Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if cfg().UserAgent != "" {
+		req.Header.Set("User-Agent", cfg().UserAgent)
+	}
+
+	resp, err := doWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !isCacheable(resp) {
+		return fmt.Errorf("response is not cacheable (%s)", resp.Status)
+	}
+	if !isAllowedContentType(resp.Header.Get("Content-Type")) {
+		return fmt.Errorf("content type %q is not allowed", resp.Header.Get("Content-Type"))
+	}
+	limit := cache.maxBytes
+	if cfg().MaxBody > 0 {
+		limit = min(limit, cfg().MaxBody)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return fmt.Errorf("body exceeds %d bytes", limit)
+	}
+
+	cleanResponseHeaders(resp.Header)
+	cache.set(cacheKey(target, req), req, resp.StatusCode, resp.Header, body, time.Now())
+	logf(ctx, "Prefetched %s (%d bytes)", target, len(body))
+	return nil
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io" // Import io for copying the response body
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copyResponseHeaders copies upstream response headers to dst, except the
+// upstream's own Access-Control-* headers (CORS is decided by the proxy) and
+// its X-Request-Id (the proxy has already set the request's own). src is the
+// final response of any redirect chain, whose origin may differ from the
+// target's and answer CORS for itself.
+func copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if !strings.HasPrefix(name, "Access-Control-") && name != requestIDHeader {
+			for _, value := range values {
+				dst.Add(name, value)
+			}
+		}
+	}
+}
+
+// proxyHandler fetches the target URL specified by the 'target' query parameter.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if !beginProxyRequest(w, r) {
+		return
+	}
+
+	// --- 2. GET TARGET URL FROM QUERY PARAMETER ---
+	// r.URL.Query() extracts the map of query parameters (e.g., "?target=..."
+	// or the base64url "?target_b64=...")
+	targetURL, err := targetFromQuery(r.URL.Query())
+	if errors.Is(err, errMissingTarget) {
+		writeError(w, http.StatusBadRequest, "Error: 'target' query parameter is missing.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: Missing 'target' query parameter.")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: 'target_b64' is not valid base64url.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: %v", err)
+		return
+	}
+	// A path such as ?target=/songs/1.mp3 is fetched from -base-url
+	targetURL, err = resolveTarget(targetURL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: Relative target URLs need a configured base URL.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: %v", err)
+		return
+	}
+
+	// An optional ?timeout=5s overrides -timeout for this request
+	timeout, err := requestTimeout(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: 'timeout' must be a positive duration such as 5s.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: %v", err)
+		return
+	}
+
+	// Pass any other query parameters (e.g. &q=jazz) on to the target
+	targetURL = proxiedTarget(r.Context(), targetURL, r.URL.Query())
+
+	// With -jsonp, ?callback=fn turns a JSON response into a script for
+	// clients that can't use CORS
+	if callback := r.URL.Query().Get(jsonpCallbackParam); cfg().JSONP && callback != "" {
+		if !jsonpCallback.MatchString(callback) {
+			writeError(w, http.StatusBadRequest, "Error: 'callback' must be a JavaScript identifier.")
+			metrics.clientErrors.Add(1)
+			logf(r.Context(), "Request failed: invalid JSONP callback %q", callback)
+			return
+		}
+		prepareJSONP(r)
+		jw := &jsonpWriter{ResponseWriter: w, ctx: r.Context(), callback: callback}
+		defer jw.finish()
+		w = jw
+	}
+
+	serveProxy(w, r, targetURL, timeout)
+}
+
+// pathProxyHandler serves /proxy/<target>, where the full target URL
+// (including its own query string) is embedded in the path, e.g.
+// /proxy/https://cdn.example.com/song.mp3?v=2.
+func pathProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if !beginProxyRequest(w, r) {
+		return
+	}
+
+	targetURL, err := targetFromPath(r.URL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: Path must contain an absolute http(s) target URL.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: %v", err)
+		return
+	}
+
+	serveProxy(w, r, proxiedTarget(r.Context(), targetURL, nil), cfg().Timeout)
+}
+
+// beginProxyRequest runs the steps shared by every proxy route before the
+// target is known: CORS, preflight and rate limiting. It returns false when
+// it has already written the response.
+func beginProxyRequest(w http.ResponseWriter, r *http.Request) bool {
+	metrics.requests.Add(1)
+
+	// --- 1. SET CORS HEADERS ---
+	setCORSHeaders(w, r)
+
+	// Handle CORS preflight requests (OPTIONS method)
+	if r.Method == http.MethodOptions {
+		setPreflightHeaders(w, r)
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+
+	if !checkOpenHours(w, r) {
+		return false
+	}
+
+	// Refuse methods we haven't been configured to forward
+	if p := corsPolicyFor(r.URL.Path); !p.allowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(p.AllowMethods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request rejected: method %s is not allowed", r.Method)
+		return false
+	}
+
+	// Throttle clients that exceed their per-IP budget
+	if limiter != nil {
+		if ok, wait := limiter.allow(clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			writeError(w, http.StatusTooManyRequests, "Too Many Requests: Rate limit exceeded.")
+			metrics.clientErrors.Add(1)
+			logf(r.Context(), "Request rejected: rate limit exceeded for %s", clientIP(r))
+			return false
+		}
+	}
+	return true
+}
+
+// serveProxy fetches targetURL on behalf of r, giving the upstream timeout to
+// respond in full, and relays the response.
+func serveProxy(w http.ResponseWriter, r *http.Request, targetURL string, timeout time.Duration) {
+	logf(r.Context(), "Proxying request to: %s", targetURL)
+
+	// --- 3. MAKE THE REQUEST TO THE TARGET URL ---
+
+	// Check the target URL is valid and permitted by the target policy
+	target, terr := checkTarget(targetURL)
+	if terr != nil {
+		writeError(w, terr.status, terr.message)
+		countError(terr.status)
+		logf(r.Context(), "Request rejected: %v", terr.err)
+		return
+	}
+	traceTarget(r.Context(), target)
+
+	// Serve repeat GETs straight from the cache without contacting the origin.
+	// A request that forwards credentials may get a personal answer, so it
+	// neither reads, fills nor shares a fetch through the cache.
+	useCache := cache != nil && r.Method == http.MethodGet && !forwardsCredentials(r)
+	if useCache {
+		key := cacheKey(targetURL, r)
+		if entry, ok := cache.get(key, r, time.Now()); ok && serveCached(w, r, targetURL, entry, "HIT") {
+			return
+		}
+		// A range of a body stored on disk is cut out of the whole file
+		if r.Header.Get("Range") != "" && cache.dir != "" {
+			if entry, ok := cache.getFull(targetURL, r, time.Now()); ok && serveCached(w, r, targetURL, entry, "HIT") {
+				return
+			}
+		}
+
+		// Concurrent misses for the same response share one upstream fetch.
+		// The first request relays it and fills the cache as usual; the rest
+		// wait for it and are then served the stored copy, so no response
+		// body is ever read by two clients. As soon as the leader finds the
+		// response won't be stored they are let go to fetch it themselves.
+		fetch, leader := inflight.join(key)
+		if leader {
+			defer fetch.release(false)
+			abortIf(relayUpstream(w, r, targetURL, timeout, true, fetch))
+			return
+		}
+		select {
+		case <-fetch.done:
+		case <-r.Context().Done():
+			logf(r.Context(), "Client disconnected while waiting for a shared fetch of %s", targetURL)
+			return
+		}
+		if entry, ok := cache.get(key, r, time.Now()); fetch.stored && ok && serveCached(w, r, targetURL, entry, "HIT") {
+			logf(r.Context(), "Served %s from a fetch shared with a concurrent request", targetURL)
+			return
+		}
+	}
+	abortIf(relayUpstream(w, r, targetURL, timeout, useCache, nil))
+}
+
+// serveCached relays a cached response for r, labelled with xCache in the
+// X-Cache header. In-memory bodies are written directly. A whole body on
+// disk is handed to http.ServeContent, which answers Range and conditional
+// requests itself and lets the server sendfile the file; other disk entries
+// are copied from their file. It reports false, having written nothing, if
+// the entry's file was evicted before it could be opened.
+func serveCached(w http.ResponseWriter, r *http.Request, targetURL string, entry *cacheEntry, xCache string) bool {
+	var file *os.File
+	if entry.file != "" {
+		var err error
+		if file, err = os.Open(entry.file); err != nil {
+			return false
+		}
+		defer file.Close()
+	}
+
+	copyResponseHeaders(w.Header(), entry.header)
+	overrideCacheControl(w.Header(), entry.status)
+	w.Header().Set("X-Cache", xCache)
+	if file != nil && entry.status == http.StatusOK && !shouldCompress(r, w.Header(), entry.status) {
+		rec := &statusRecorder{ResponseWriter: w}
+		modTime, _ := http.ParseTime(entry.header.Get("Last-Modified"))
+		http.ServeContent(rec, r, "", modTime, file)
+		metrics.successes.Add(1)
+		metrics.bytesTransferred.Add(rec.bytes)
+		promMetrics.bytesTransferred.Add(float64(rec.bytes))
+		logAccess(r, targetURL, rec.status, rec.bytes, 0)
+		return true
+	}
+
+	out, closeOut := compressWriter(w, r, w.Header(), entry.status)
+	w.WriteHeader(entry.status)
+	var written int64
+	if file != nil {
+		written, _ = io.Copy(out, file)
+	} else {
+		n, _ := out.Write(entry.body)
+		written = int64(n)
+	}
+	closeOut()
+	metrics.successes.Add(1)
+	metrics.bytesTransferred.Add(written)
+	promMetrics.bytesTransferred.Add(float64(written))
+	logAccess(r, targetURL, entry.status, written, 0)
+	return true
+}
+
+// serveStale stands in for a failed upstream fetch of targetURL with the
+// expired cached copy, if -serve-stale-on-error still allows it, so playback
+// survives a brief origin outage. It reports whether it served one; why the
+// fetch failed is only logged.
+func serveStale(w http.ResponseWriter, r *http.Request, targetURL string, useCache bool, why string) bool {
+	if !useCache || cfg().ServeStale <= 0 {
+		return false
+	}
+	entry, ok := cache.getStale(cacheKey(targetURL, r), r, time.Now())
+	if !ok {
+		return false
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	if !serveCached(w, r, targetURL, entry, "STALE") {
+		w.Header().Del("Warning")
+		return false
+	}
+	logf(r.Context(), "Served stale copy of %s: %s", targetURL, why)
+	return true
+}
+
+// abortIf aborts the client connection when a relayed body was truncated.
+// The headers are long gone by then, so that is the only way to signal it.
+func abortIf(truncated bool) {
+	if truncated {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// relayUpstream fetches targetURL on behalf of r and relays the response,
+// storing it in the cache if useCache is set. When r leads a shared fetch,
+// fetch is released as soon as it is clear whether the response gets stored.
+// It reports whether the body was cut short at -max-body, in which case the
+// caller must abort the connection.
+func relayUpstream(w http.ResponseWriter, r *http.Request, targetURL string, timeout time.Duration, useCache bool, fetch *pendingFetch) bool {
+	if useCache {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	// Leave the rest of the upstream capacity to other hosts when this one is busy
+	if hostLimit != nil {
+		host := targetHost(targetURL)
+		if !hostLimit.acquire(r, host) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Service Unavailable: Too many concurrent requests to the target host.")
+			logf(r.Context(), "Request rejected: %d concurrent requests to %s already in flight", cfg().MaxPerHost, host)
+			return false
+		}
+		defer hostLimit.release(host)
+	}
+
+	// Forward the client's body for methods that carry one (POST, PUT, ...).
+	// r.Body is passed straight through so uploads are streamed, not buffered.
+	var body io.Reader
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		body = r.Body
+	}
+	defer r.Body.Close()
+
+	// Create a new request to the target URL. Tying it to the incoming
+	// request's context means a client disconnect cancels the upstream fetch.
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal Server Error: Failed to create request")
+		logf(r.Context(), "Error creating request: %v", err)
+		return false
+	}
+
+	// Copy the client headers we've been told to pass on (auth tokens etc.)
+	copyForwardHeaders(req.Header, r.Header, cfg().ForwardHeaders)
+	setUserAgent(req, r)
+	setHost(req, r)
+	setForwarded(req, r)
+	if id := requestIDFrom(r.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	if body != nil {
+		// Keep the original framing so the upstream sees the same payload type and size
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+		req.ContentLength = r.ContentLength
+	}
+
+	// Pass byte-range headers through so <audio> seeking gets a 206 from
+	// upstream, validators so an unchanged file comes back as a bodiless 304,
+	// and Accept-Encoding so an upstream-compressed body can be relayed as is
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	// Execute the request on the shared, connection-pooling client, retrying
+	// transient failures when configured. Timing starts here so the access
+	// log covers the round trip plus the body copy.
+	start := time.Now()
+	resp, err := doWithRetry(req)
+	upstreamTime := time.Since(start)
+	if err != nil {
+		if clientGone(r) {
+			// Nobody is left to read an error response
+			logf(r.Context(), "Client disconnected before %s responded; upstream fetch cancelled", targetURL)
+			return false
+		}
+		if errors.Is(err, errRedirectBlocked) {
+			writeError(w, http.StatusForbidden, "Error: Target redirected to a host that is not allowed.")
+			metrics.clientErrors.Add(1)
+			logf(r.Context(), "Request rejected: %v", err)
+			return false
+		}
+		if errors.Is(err, errPrivateAddress) {
+			writeError(w, http.StatusForbidden, "Error: Target resolves to a private address.")
+			metrics.clientErrors.Add(1)
+			logf(r.Context(), "Request rejected: %v", err)
+			return false
+		}
+		if errors.Is(err, errRedirectLoop) {
+			writeError(w, http.StatusLoopDetected, "Loop Detected: Target redirects in a loop.")
+			metrics.upstreamErrors.Add(1)
+			logf(r.Context(), "Request failed: %v", err)
+			return false
+		}
+		if serveStale(w, r, targetURL, useCache, err.Error()) {
+			return false
+		}
+		if errors.Is(err, errCircuitOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(cfg().BreakerCooldown)))
+			writeError(w, http.StatusServiceUnavailable, "Service Unavailable: Target host is failing, try again later.")
+			metrics.upstreamErrors.Add(1)
+			logf(r.Context(), "Request rejected: %v", err)
+			return false
+		}
+		switch upstreamErrorStatus(err) {
+		case http.StatusGatewayTimeout:
+			writeError(w, http.StatusGatewayTimeout, "Gateway Timeout: Target URL took too long to respond")
+			logf(r.Context(), "Timed out fetching target: %v", err)
+		case http.StatusBadGateway:
+			writeError(w, http.StatusBadGateway, "Bad Gateway: Failed to fetch from target URL")
+			logf(r.Context(), "Error fetching target: %v", err)
+		default:
+			writeError(w, http.StatusInternalServerError, "Internal Server Error: Failed to fetch from target URL")
+			logf(r.Context(), "Internal error fetching target: %v", err)
+		}
+		metrics.upstreamErrors.Add(1)
+		return false
+	}
+	defer resp.Body.Close() // Ensure the response body is closed
+
+	if resp.StatusCode >= 500 && serveStale(w, r, targetURL, useCache, "upstream responded "+resp.Status) {
+		return false
+	}
+
+	// Refuse bodies we already know are too big, while we can still say so
+	if cfg().MaxBody > 0 && resp.ContentLength > cfg().MaxBody {
+		writeError(w, http.StatusBadGateway, "Bad Gateway: Target response exceeds the maximum allowed size")
+		metrics.upstreamErrors.Add(1)
+		logf(r.Context(), "Response from %s rejected: Content-Length %d exceeds -max-body %d", targetURL, resp.ContentLength, cfg().MaxBody)
+		return false
+	}
+
+	// Only relay the kinds of content we're meant to carry. A 304 has no body,
+	// so there's nothing to check.
+	if resp.StatusCode != http.StatusNotModified && !isAllowedContentType(resp.Header.Get("Content-Type")) {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		writeError(w, http.StatusUnsupportedMediaType, "Unsupported Media Type: Target content type is not allowed")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Response from %s rejected: content type %q is not allowed", targetURL, resp.Header.Get("Content-Type"))
+		return false
+	}
+
+	// --- 4. RELAY THE RESPONSE ---
+
+	// Only end-to-end headers may cross the proxy; the connection-level ones
+	// (Transfer-Encoding, Keep-Alive, ...) belong to the upstream hop
+	cleanResponseHeaders(resp.Header)
+	copyResponseHeaders(w.Header(), resp.Header)
+	overrideCacheControl(w.Header(), resp.StatusCode)
+	setServerTiming(w.Header(), upstreamTime)
+
+	// HEAD is used by players to check Content-Length and Accept-Ranges before
+	// streaming; the headers above are all they need, so skip the body entirely.
+	if r.Method == http.MethodHead {
+		w.WriteHeader(resp.StatusCode)
+		metrics.successes.Add(1)
+		promMetrics.upstreamDuration.Observe(time.Since(start).Seconds())
+		logAccess(r, targetURL, resp.StatusCode, 0, time.Since(start))
+		return false
+	}
+
+	// Gzip text-like bodies on the way out when enabled; this may rewrite
+	// Content-Length and Content-Encoding, so it must run before WriteHeader
+	out, closeOut := compressWriter(newFlushWriter(w), r, w.Header(), resp.StatusCode)
+
+	// Set the status code (including 206 Partial Content, whose Content-Range
+	// and Accept-Ranges headers were copied above) and copy the body directly
+	w.WriteHeader(resp.StatusCode)
+
+	// While streaming, keep a copy of cacheable bodies for later requests.
+	// The copy is taken before compression so the cache holds upstream bytes.
+	var dst io.Writer = out
+	var captured *cappedBuffer
+	if useCache && isCacheable(resp) && resp.ContentLength <= cache.maxBytes {
+		captured = &cappedBuffer{limit: cache.maxBytes, onOverflow: func() { fetch.release(false) }}
+		dst = io.MultiWriter(out, captured)
+	} else {
+		// Nothing will be stored, so waiting followers needn't sit through the body
+		fetch.release(false)
+	}
+
+	// Stream the response body (the audio file) in -copy-buffer-size chunks,
+	// each flushed to the client as soon as it arrives so playback can start
+	var src io.Reader = resp.Body
+	if cfg().MaxBody > 0 {
+		src = io.LimitReader(resp.Body, cfg().MaxBody)
+	}
+	if cfg().ByteRate > 0 {
+		src = newThrottledReader(r.Context(), src, cfg().ByteRate)
+	}
+	buf := getCopyBuffer()
+	written, err := io.CopyBuffer(dst, src, *buf)
+	copyBuffers.Put(buf)
+	if closeErr := closeOut(); err == nil {
+		err = closeErr
+	}
+
+	// If the upstream still has data after the limit, the client only got a
+	// prefix, and the caller has to abort the connection to signal it
+	if err == nil && cfg().MaxBody > 0 && written == cfg().MaxBody {
+		if n, _ := resp.Body.Read(make([]byte, 1)); n > 0 {
+			metrics.bytesTransferred.Add(written)
+			promMetrics.bytesTransferred.Add(float64(written))
+			metrics.upstreamErrors.Add(1)
+			logf(r.Context(), "Response from %s truncated at -max-body %d bytes; closing connection", targetURL, cfg().MaxBody)
+			return true
+		}
+	}
+	metrics.bytesTransferred.Add(written)
+	promMetrics.bytesTransferred.Add(float64(written))
+	promMetrics.upstreamDuration.Observe(time.Since(start).Seconds())
+	if err != nil && clientGone(r) {
+		logf(r.Context(), "Client disconnected after %d bytes; upstream fetch from %s cancelled", written, targetURL)
+	} else if err != nil {
+		logf(r.Context(), "Error copying response body: %v", err)
+	} else {
+		metrics.successes.Add(1)
+		if captured != nil && !captured.overflowed {
+			cache.set(cacheKey(targetURL, r), r, resp.StatusCode, resp.Header, captured.buf, time.Now())
+			fetch.release(true)
+		}
+	}
+
+	logAccess(r, targetURL, resp.StatusCode, written, time.Since(start))
+	return false
+}
+
+// copyBuffers recycles the body copy buffers, so relaying doesn't allocate
+// -copy-buffer-size bytes per request under load.
+var copyBuffers sync.Pool
+
+// getCopyBuffer returns a -copy-buffer-size buffer from copyBuffers. Buffers
+// of another size, left from before a configuration change, are dropped.
+func getCopyBuffer() *[]byte {
+	if buf, ok := copyBuffers.Get().(*[]byte); ok && len(*buf) == cfg().CopyBufferSize {
+		return buf
+	}
+	buf := make([]byte, cfg().CopyBufferSize)
+	return &buf
+}
+
+// clientGone reports whether r's client has disconnected. Its context is
+// cancelled then, which also tears down the upstream fetch built from it.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
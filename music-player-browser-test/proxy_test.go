@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// proxyGet sends a GET for target through proxyHandler with the given
+// request headers and returns the recorded response.
+func proxyGet(target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(target), nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, req)
+	return rec
+}
+
+func TestRangeRequestIsRelayed(t *testing.T) {
+	withConfig(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Range"); got != "bytes=100-199" {
+			t.Errorf("upstream got Range %q", got)
+		}
+		if got := r.Header.Get("If-Range"); got != `"v1"` {
+			t.Errorf("upstream got If-Range %q", got)
+		}
+		w.Header().Set("Content-Range", "bytes 100-199/1000")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+
+	rec := proxyGet(srv.URL+"/song.mp3", http.Header{"Range": {"bytes=100-199"}, "If-Range": {`"v1"`}})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 100-199/1000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q", got)
+	}
+	if rec.Body.Len() != 100 {
+		t.Errorf("got %d body bytes, want 100", rec.Body.Len())
+	}
+}
+
+func TestHeadRelaysHeadersWithoutBody(t *testing.T) {
+	withConfig(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("upstream got %s, want HEAD", r.Method)
+		}
+		w.Header().Set("Content-Length", "12345")
+		w.Header().Set("Accept-Ranges", "bytes")
+	}))
+	defer srv.Close()
+	px := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer px.Close()
+
+	resp, err := http.Head(px.URL + "/?target=" + url.QueryEscape(srv.URL+"/song.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != 12345 {
+		t.Errorf("Content-Length = %d, want 12345", resp.ContentLength)
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q", got)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Errorf("got %d body bytes, want none", len(body))
+	}
+}
+
+func TestNotModifiedIsRelayedWithoutBody(t *testing.T) {
+	withConfig(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("song"))
+	}))
+	defer srv.Close()
+
+	rec := proxyGet(srv.URL, http.Header{"If-None-Match": {`"v1"`}})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("got %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("got body %q, want none", rec.Body.String())
+	}
+	if got := rec.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("ETag = %q", got)
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	withConfig(t, nil)
+	sent, closed := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		close(sent)
+		<-r.Context().Done()
+		close(closed)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(srv.URL), nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		proxyHandler(rec, req)
+		close(done)
+	}()
+
+	<-sent
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream fetch outlived the client")
+	}
+	<-done
+	if rec.Code == http.StatusInternalServerError {
+		t.Error("a client disconnect was answered as a 500")
+	}
+}
+
+// discardRecorder records a response's status and headers but throws its
+// body away, so a benchmark measures the relay rather than buffering.
+type discardRecorder struct{ *httptest.ResponseRecorder }
+
+func (d discardRecorder) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 16<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(body) }))
+	defer srv.Close()
+	target := "/?target=" + url.QueryEscape(srv.URL)
+
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			withConfig(b, func(c *Config) { c.CopyBufferSize = size })
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				proxyHandler(discardRecorder{httptest.NewRecorder()}, httptest.NewRequest(http.MethodGet, target, nil))
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// limiterIdleTTL is how long a client's bucket is kept after its last request.
+const limiterIdleTTL = 10 * time.Minute
+
+// tokenBucket is a single client's budget. tokens refill continuously at the
+// limiter's rate up to its burst size.
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	lastSeen time.Time
+}
+
+// rateLimiter hands out per-key token buckets.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// limiter is built in main when rate is set; nil disables rate limiting.
+var limiter *rateLimiter
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup drops buckets that have been idle longer than limiterIdleTTL, so
+// the map doesn't grow with every client ever seen.
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > limiterIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// runCleanup periodically calls cleanup. It never returns.
+func (l *rateLimiter) runCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.cleanup(now)
+	}
+}
+
+// retryAfterSeconds rounds wait up to whole seconds for a Retry-After header.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
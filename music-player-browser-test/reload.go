@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// startupSettings are the settings main only reads once, to start listening
+// or to build the client, cache, limiters and the like. A reload can't apply
+// them, so it keeps their running values and logs that they were ignored.
+var startupSettings = map[string]bool{
+	"addr": true, "unix": true, "max-header-bytes": true,
+	"tls-cert": true, "tls-key": true, "client-ca": true, "autocert-domains": true, "autocert-cache": true,
+	"log-format": true, "pprof-addr": true, "debug": true,
+	"access-log": true, "access-log-max-size": true, "access-log-max-files": true,
+	"allowed-hours": true, "timezone": true,
+	"max-idle-conns": true, "max-idle-conns-per-host": true, "max-conns-per-host": true,
+	"idle-conn-timeout": true, "dial-timeout": true, "response-header-timeout": true,
+	"dns-cache-ttl": true, "dns-server": true, "upstream-proxy": true, "disable-http2": true,
+	"upstream-client-cert": true, "upstream-client-key": true,
+	"upstream-ca": true, "upstream-ca-system": true, "insecure-skip-verify": true,
+	"rate": true, "burst": true, "max-per-host": true,
+	"max-concurrent": true, "max-concurrent-mode": true, "max-concurrent-wait": true,
+	"breaker-failures": true, "breaker-window": true, "breaker-cooldown": true,
+	"cache-ttl": true, "cache-max-bytes": true, "cache-dir": true, "serve-stale-on-error": true, "prefetch": true,
+	"duration-buckets": true,
+}
+
+// reloadOnHangup reloads the configuration from args, the same arguments it
+// was first loaded from, every time the process gets SIGHUP. It never
+// returns.
+func reloadOnHangup(args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig(args)
+	}
+}
+
+// reloadConfig loads and validates the configuration again and swaps it in
+// for the live one. On any error the live configuration stays as it is.
+func reloadConfig(args []string) {
+	loaded, err := LoadConfig(args, os.LookupEnv)
+	if err == nil {
+		err = loaded.Validate()
+	}
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	if ignored := keepStartupSettings(loaded, cfg()); len(ignored) > 0 {
+		log.Printf("Reload ignored changes to settings that need a restart: %s", strings.Join(ignored, ", "))
+	}
+	liveConfig.Store(loaded)
+	log.Printf("Configuration reloaded")
+}
+
+// keepStartupSettings copies the startupSettings of running into loaded and
+// returns the names of those that loaded had changed.
+func keepStartupSettings(loaded, running *Config) []string {
+	var ignored []string
+	next, cur := reflect.ValueOf(loaded).Elem(), reflect.ValueOf(running).Elem()
+	for i := 0; i < next.NumField(); i++ {
+		name, _, _ := strings.Cut(next.Type().Field(i).Tag.Get("yaml"), ",")
+		if !startupSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(next.Field(i).Interface(), cur.Field(i).Interface()) {
+			ignored = append(ignored, name)
+			next.Field(i).Set(cur.Field(i))
+		}
+	}
+	return ignored
+}
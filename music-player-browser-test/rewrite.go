@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+)
+
+// RewriteRule is a rewrite-rules entry (config file only): a target URL
+// matching Match is replaced by Replace, in which $1 or ${name} stand for
+// Match's submatches, e.g. to swap a CDN host or append a token.
+type RewriteRule struct {
+	Match   urlPattern `yaml:"match"`
+	Replace string     `yaml:"replace"`
+}
+
+// urlPattern is a regular expression compiled when the config is loaded.
+type urlPattern struct{ *regexp.Regexp }
+
+// UnmarshalText lets config files give patterns as plain strings.
+func (p *urlPattern) UnmarshalText(text []byte) error {
+	re, err := regexp.Compile(string(text))
+	if err != nil {
+		return err
+	}
+	p.Regexp = re
+	return nil
+}
+
+// rewriteTarget applies the rewrite rules to target in order. Only the first
+// matching rule is applied unless -rewrite-all is set, in which case each
+// matching rule sees the previous one's result. A target no rule matches is
+// returned unchanged. The result still has to pass checkTarget.
+func rewriteTarget(target string) string {
+	for _, rule := range cfg().RewriteRules {
+		if !rule.Match.MatchString(target) {
+			continue
+		}
+		target = rule.Match.ReplaceAllString(target, rule.Replace)
+		if !cfg().RewriteAll {
+			break
+		}
+	}
+	return target
+}
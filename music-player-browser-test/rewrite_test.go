@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// noEnv is a LoadConfig lookup with no environment variables set.
+func noEnv(string) (string, bool) { return "", false }
+
+func TestRewriteRulesOrdering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	rules := `rewrite-rules:
+  - match: '^https://old\.cdn\.example/(.*)$'
+    replace: 'https://new.cdn.example/$1'
+  - match: '^https://new\.cdn\.example/.*'
+    replace: '${0}?token=abc'
+`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig([]string{"-config", path}, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	prev := cfg()
+	liveConfig.Store(c)
+	defer liveConfig.Store(prev)
+
+	for _, tc := range []struct {
+		all          bool
+		target, want string
+	}{
+		{false, "https://old.cdn.example/a.mp3", "https://new.cdn.example/a.mp3"},
+		{false, "https://new.cdn.example/a.mp3", "https://new.cdn.example/a.mp3?token=abc"},
+		{true, "https://old.cdn.example/a.mp3", "https://new.cdn.example/a.mp3?token=abc"},
+		{false, "https://other.example/x", "https://other.example/x"},
+		{true, "https://other.example/x", "https://other.example/x"},
+	} {
+		c.RewriteAll = tc.all
+		if got := rewriteTarget(tc.target); got != tc.want {
+			t.Errorf("rewrite-all=%v: rewriteTarget(%q) = %q, want %q", tc.all, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteRulesRejectBadPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte("rewrite-rules:\n  - match: '('\n    replace: x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig([]string{"-config", path}, noEnv); err == nil {
+		t.Error("a rule with an invalid regular expression was accepted")
+	}
+}
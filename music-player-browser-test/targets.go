@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errMissingTarget is returned by targetFromQuery when neither target
+// parameter is present.
+var errMissingTarget = errors.New("missing target")
+
+// targetFromQuery extracts the target URL from the query string. A
+// base64url-encoded "target_b64" wins over a plain "target", since it survives
+// inner query strings intact. Padding on the encoded value is optional.
+func targetFromQuery(q url.Values) (string, error) {
+	if encoded := q.Get("target_b64"); encoded != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return "", fmt.Errorf("malformed target_b64: %v", err)
+		}
+		return string(decoded), nil
+	}
+	if target := q.Get("target"); target != "" {
+		return target, nil
+	}
+	return "", errMissingTarget
+}
+
+// errRelativeTarget is returned by resolveTarget for a relative target when
+// no -base-url is configured.
+var errRelativeTarget = errors.New("relative target without -base-url")
+
+// resolveTarget resolves a relative target against -base-url. Absolute
+// targets are returned unchanged.
+func resolveTarget(target string) (string, error) {
+	ref, err := url.Parse(target)
+	if err != nil || ref.IsAbs() {
+		// Unparsable targets are left for checkTarget to reject
+		return target, nil
+	}
+	if cfg().BaseURL == "" {
+		return "", errRelativeTarget
+	}
+	base, err := url.Parse(cfg().BaseURL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// proxyQueryParams are consumed by the proxy itself; every other query
+// parameter on a ?target= request is passed on to the upstream.
+var proxyQueryParams = []string{"target", "target_b64", "timeout"}
+
+// withExtraQuery appends the request's non-proxy query parameters to target.
+// Keys the target already has are kept and the new values added after them,
+// so nothing in the original target is overwritten. An unparsable target is
+// returned unchanged for the caller's validation to reject.
+func withExtraQuery(target string, q url.Values) string {
+	extra := url.Values{}
+	for key, values := range q {
+		if !isProxyQueryParam(key) {
+			extra[key] = values
+		}
+	}
+	if len(extra) == 0 {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = extra.Encode()
+	} else {
+		u.RawQuery += "&" + extra.Encode()
+	}
+	return u.String()
+}
+
+// proxiedTarget finishes a resolved target the way the proxy routes do:
+// the request query q's extra parameters are appended, then -rewrite-rules
+// applied. The result is both the URL fetched and the cache key's target, so
+// the purge route builds its target here too.
+func proxiedTarget(ctx context.Context, target string, q url.Values) string {
+	target = withExtraQuery(target, q)
+	if rewritten := rewriteTarget(target); rewritten != target {
+		logf(ctx, "Rewrote target %s to %s", target, rewritten)
+		target = rewritten
+	}
+	return target
+}
+
+// isProxyQueryParam reports whether key is one of proxyQueryParams, or the
+// JSONP callback when -jsonp is on.
+func isProxyQueryParam(key string) bool {
+	if cfg().JSONP && key == jsonpCallbackParam {
+		return true
+	}
+	for _, name := range proxyQueryParams {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pathProxyPrefix is the route under which targets are embedded in the path.
+const pathProxyPrefix = "/proxy/"
+
+// targetFromPath extracts the target from a /proxy/<scheme>://<host>/...
+// request URL. The escaped path is used so encoded characters in the target
+// survive, and the request's query string belongs to the target.
+func targetFromPath(u *url.URL) (string, error) {
+	target := strings.TrimPrefix(u.EscapedPath(), pathProxyPrefix)
+	scheme, rest, ok := strings.Cut(target, ":/")
+	if !ok || scheme == "" || strings.Contains(scheme, "/") {
+		return "", fmt.Errorf("target %q has no scheme", target)
+	}
+	// Some clients and proxies collapse "//" in paths; put it back
+	target = scheme + "://" + strings.TrimPrefix(rest, "/")
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return target, nil
+}
+
+// withPathTargets sends /proxy/ requests to h before they reach next. The
+// full target URL contains "//", which http.ServeMux would clean and redirect.
+func withPathTargets(next, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, pathProxyPrefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// targetError explains why checkTarget refused a target: status and message
+// are sent to the client, err is logged.
+type targetError struct {
+	status  int
+	message string
+	err     error
+}
+
+// checkTarget parses targetURL and applies the proxy's target policy: it
+// must be a valid absolute URL on an allowed host that resolves to public
+// addresses. Every route that fetches on a client's behalf goes through here.
+func checkTarget(targetURL string) (*url.URL, *targetError) {
+	parsedURL, err := url.ParseRequestURI(targetURL)
+	if err != nil {
+		return nil, &targetError{http.StatusBadRequest, "Error: Invalid target URL format.",
+			fmt.Errorf("invalid target URL format: %v", err)}
+	}
+	if terr := checkTargetURL(parsedURL); terr != nil {
+		return nil, terr
+	}
+	return parsedURL, nil
+}
+
+// checkTargetURL applies the target policy to an already parsed URL. It is
+// shared by checkTarget and checkRedirect, so a redirect hop is held to
+// exactly the same rules as the URL a client asked for.
+func checkTargetURL(parsedURL *url.URL) *targetError {
+	// Refuse file://, ftp:// and friends before anything else looks at the URL
+	if !isAllowedScheme(parsedURL.Scheme) {
+		return &targetError{http.StatusBadRequest, "Error: Target URL scheme is not allowed.",
+			fmt.Errorf("target scheme %q is not allowed", parsedURL.Scheme)}
+	}
+	if !isAllowedPort(parsedURL) {
+		return &targetError{http.StatusForbidden, "Error: Target port is not allowed.",
+			fmt.Errorf("target port of %q is not allowed", parsedURL.Host)}
+	}
+	host := parsedURL.Hostname()
+
+	// Banned hosts are refused even if the allowlist would let them through
+	if isBlockedTarget(host) {
+		return &targetError{http.StatusForbidden, "Error: Target host is blocked.",
+			fmt.Errorf("target host %q is in the blocklist", host)}
+	}
+
+	// Only relay to hosts we have been told to trust
+	if !isAllowedTarget(host) {
+		return &targetError{http.StatusForbidden, "Error: Target host is not allowed.",
+			fmt.Errorf("target host %q is not in the allowlist", host)}
+	}
+
+	// Keep the proxy from being used to reach internal services (SSRF)
+	if !cfg().AllowPrivate {
+		public, err := isPublicAddress(host)
+		if err != nil {
+			return &targetError{http.StatusBadGateway, "Error: Failed to resolve target host.",
+				fmt.Errorf("resolving target host %q: %v", host, err)}
+		}
+		if !public {
+			return &targetError{http.StatusForbidden, "Error: Target resolves to a private address.",
+				fmt.Errorf("target host %q resolves to a private address", host)}
+		}
+	}
+	return nil
+}
+
+// targetHost returns the host[:port] of a target that passed checkTarget,
+// the key per-host state such as hostLimit is kept under.
+func targetHost(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// isAllowedScheme reports whether scheme is in the configured list.
+func isAllowedScheme(scheme string) bool {
+	for _, s := range cfg().AllowSchemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPorts are the ports a target URL without one connects to.
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443"}
+
+// isAllowedPort reports whether u's port, or its scheme's default, is in
+// -allow-ports. With no list configured every port is permitted.
+func isAllowedPort(u *url.URL) bool {
+	if len(cfg().AllowPorts) == 0 {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[strings.ToLower(u.Scheme)]
+	}
+	for _, p := range cfg().AllowPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedTarget reports whether host may be proxied. With no allowlist
+// configured every host is permitted.
+func isAllowedTarget(host string) bool {
+	if len(cfg().AllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range cfg().AllowHosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedTarget reports whether host matches an entry of -block-hosts.
+func isBlockedTarget(host string) bool {
+	for _, pattern := range cfg().BlockHosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether host matches pattern. A pattern is either an
+// exact hostname or "*.domain", which matches any subdomain of domain (but
+// not domain itself). Comparison is case-insensitive.
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// isPublicAddress resolves host and reports whether every address it maps to
+// is publicly routable. A single loopback, link-local or private answer is
+// enough to reject the host, so a name that mixes public and internal records
+// can't be used to reach internal services.
+func isPublicAddress(host string) (bool, error) {
+	ips, err := lookupIP(context.Background(), host)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return false, nil
+		}
+	}
+	return len(ips) > 0, nil
+}
+
+// isPublicIP reports whether ip is outside the loopback, link-local,
+// private (RFC 1918 / RFC 4193) and unspecified ranges.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified())
+}
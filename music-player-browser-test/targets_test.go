@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAllowPortsRejectsTargetsAndRedirects(t *testing.T) {
+	redirects := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hop" {
+			redirects++
+			http.Redirect(w, r, "http://127.0.0.1:8080/song.mp3", http.StatusFound)
+			return
+		}
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	withConfig(t, func(c *Config) { c.AllowPorts = []string{"80", "443", port} })
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"http://example.com:8080/song.mp3", http.StatusForbidden},
+		{srv.URL + "/hop", http.StatusForbidden},
+		{srv.URL + "/song.mp3", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?target="+url.QueryEscape(tc.target), nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+	if redirects != 1 {
+		t.Errorf("redirecting upstream was asked %d times, want 1", redirects)
+	}
+}
+
+func TestIsAllowedPortUsesSchemeDefaults(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AllowPorts = []string{"80", "443"} })
+	for raw, want := range map[string]bool{
+		"http://example.com/":      true,
+		"https://example.com/":     true,
+		"http://example.com:443/":  true,
+		"http://example.com:8080/": false,
+		"wss://example.com/":       true,
+	} {
+		u, _ := url.Parse(raw)
+		if got := isAllowedPort(u); got != want {
+			t.Errorf("isAllowedPort(%s) = %v, want %v", raw, got, want)
+		}
+	}
+
+	c := defaultConfig()
+	c.AllowPorts = []string{"http"}
+	if c.Validate() == nil {
+		t.Error("Validate accepted a non-numeric allow-ports entry")
+	}
+}
+
+func TestNonHTTPSchemesAreRejected(t *testing.T) {
+	withConfig(t, nil)
+	for _, target := range []string{"file:///etc/passwd", "ftp://example.com/song.mp3", "gopher://example.com/"} {
+		rec := proxyGet(target, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, rec.Code)
+		}
+	}
+	if _, terr := checkTarget("HTTPS://example.com/"); terr != nil && terr.status == http.StatusBadRequest {
+		t.Errorf("an upper-case https scheme was refused: %v", terr.err)
+	}
+}
+
+func TestBlockHostsAppliesToTargetsAndRedirects(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hop" {
+			http.Redirect(w, r, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/song.mp3", http.StatusFound)
+			return
+		}
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+	withConfig(t, func(c *Config) {
+		c.FollowRedirects = true
+		c.AllowHosts = []string{"127.0.0.1", "localhost", "*.example.com"}
+		c.BlockHosts = []string{"localhost", "*.bad.example.com"}
+	})
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{srv.URL + "/song.mp3", http.StatusOK},
+		{srv.URL + "/hop", http.StatusForbidden},
+		{strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), http.StatusForbidden},
+		{"http://cdn.bad.example.com/", http.StatusForbidden},
+	} {
+		if rec := proxyGet(tc.target, nil); rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"cdn.example.com", "cdn.example.com", true},
+		{"cdn.example.com", "CDN.Example.com.", true},
+		{"cdn.example.com", "a.cdn.example.com", false},
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evil-example.com", false},
+	} {
+		if got := hostMatches(tc.pattern, tc.host); got != tc.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tc.pattern, tc.host, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttledReader limits reads from r to rate bytes per second using a token
+// bucket that holds at most one second's worth of tokens. Waiting for tokens
+// gives up as soon as ctx is done, so a cancelled request is never stuck in
+// the limiter.
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, bytesPerSecond int64) *throttledReader {
+	return &throttledReader{ctx: ctx, r: r, rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+
+	if t.tokens < 1 {
+		wait := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return 0, t.ctx.Err()
+		}
+		now = time.Now()
+		t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+		t.last = now
+	}
+
+	// Never read more than the bucket allows right now
+	if n := int(t.tokens); n < len(p) {
+		p = p[:n]
+	}
+	n, err := t.r.Read(p)
+	t.tokens -= float64(n)
+	return n, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the proxy's spans. It is a no-op until setupTracing
+// installs a real provider.
+var tracer = otel.Tracer("cors-proxy")
+
+// tracingEnabled is set by setupTracing once an exporter is configured.
+var tracingEnabled bool
+
+// setupTracing exports spans over OTLP/HTTP when the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variable
+// is set; the exporter, sampler and resource read the rest of the OTEL_*
+// variables themselves. Without an endpoint tracing stays off and shutdown
+// does nothing.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// withTracing runs h in a server span that continues any trace the client's
+// traceparent header started. With tracing off h is returned as is.
+func withTracing(h http.Handler) http.Handler {
+	if !tracingEnabled {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "proxy "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceTarget notes the target host on the request's server span, if any.
+func traceTarget(ctx context.Context, target *url.URL) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("proxy.target.host", target.Hostname()))
+}
+
+// startUpstreamSpan starts the client span for one upstream attempt of req
+// and injects it into req's headers, so the upstream can continue the trace.
+func startUpstreamSpan(req *http.Request) trace.Span {
+	ctx, span := tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return span
+}
+
+// endUpstreamSpan records the outcome of an upstream attempt on span.
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= 500:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	span.End()
+}
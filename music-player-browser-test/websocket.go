@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketRequestHeaders are the client headers that make up a WebSocket
+// handshake and are passed on to the upstream, in addition to -forward-headers.
+var webSocketRequestHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-WebSocket-Key",
+	"Sec-WebSocket-Version",
+	"Sec-WebSocket-Protocol",
+	"Sec-WebSocket-Extensions",
+}
+
+// webSocketHandler serves /ws?target=wss://..., relaying a WebSocket
+// connection to the target. The handshake is forwarded upstream and, once
+// the upstream has switched protocols, the client connection is hijacked and
+// bytes are copied both ways untouched until either side closes. Targets go
+// through the same policy as HTTP ones; since browsers don't apply CORS to
+// WebSockets, the Origin is checked against -origins here instead.
+func webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !beginProxyRequest(w, r) {
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		writeError(w, http.StatusBadRequest, "Error: Expected a WebSocket upgrade request.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: /ws request without Upgrade: websocket")
+		return
+	}
+	if origin, p := r.Header.Get("Origin"), corsPolicyFor(r.URL.Path); len(p.Origins) > 0 && !p.allowsOrigin(origin) {
+		writeError(w, http.StatusForbidden, "Error: Origin is not allowed.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request rejected: WebSocket origin %q is not allowed", origin)
+		return
+	}
+
+	targetURL, err := targetFromQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: 'target' query parameter is missing or invalid.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: %v", err)
+		return
+	}
+	targetURL = rewriteTarget(targetURL)
+	// The upgrade itself is an HTTP request, so fetch and vet it as one
+	httpURL, ok := webSocketToHTTP(targetURL)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Error: Target must be a ws:// or wss:// URL.")
+		metrics.clientErrors.Add(1)
+		logf(r.Context(), "Request failed: WebSocket target %q is not ws(s)", targetURL)
+		return
+	}
+	if _, terr := checkTarget(httpURL); terr != nil {
+		writeError(w, terr.status, terr.message)
+		countError(terr.status)
+		logf(r.Context(), "Request rejected: %v", terr.err)
+		return
+	}
+
+	// The deadline only covers the handshake: the connection outlives the
+	// handler's usual request lifetime once upgraded
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	timer := time.AfterFunc(cfg().WSUpgradeTimeout, cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal Server Error: Failed to create request")
+		logf(r.Context(), "Error creating request: %v", err)
+		return
+	}
+	copyForwardHeaders(req.Header, r.Header, cfg().ForwardHeaders)
+	for _, name := range webSocketRequestHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Header[name] = values
+		}
+	}
+	setUserAgent(req, r)
+	setHost(req, r)
+	setForwarded(req, r)
+	if id := requestIDFrom(r.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	logf(r.Context(), "Opening WebSocket to: %s", targetURL)
+	resp, err := client.Transport.RoundTrip(req)
+	stopped := timer.Stop()
+	if err != nil {
+		if !stopped {
+			writeError(w, http.StatusGatewayTimeout, "Gateway Timeout: WebSocket upgrade took too long")
+		} else {
+			writeError(w, http.StatusBadGateway, "Bad Gateway: Failed to connect to WebSocket target")
+		}
+		metrics.upstreamErrors.Add(1)
+		logf(r.Context(), "Error opening WebSocket to %s: %v", targetURL, err)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		writeError(w, http.StatusBadGateway, "Bad Gateway: Target refused the WebSocket upgrade")
+		metrics.upstreamErrors.Add(1)
+		logf(r.Context(), "WebSocket target %s answered the upgrade with %s", targetURL, resp.Status)
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		writeError(w, http.StatusBadGateway, "Bad Gateway: Target connection can't be upgraded")
+		metrics.upstreamErrors.Add(1)
+		logf(r.Context(), "WebSocket target %s switched protocols without a writable body", targetURL)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal Server Error: Connection can't be upgraded")
+		logf(r.Context(), "Error hijacking client connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Relay the upstream's 101 as-is; it carries Sec-WebSocket-Accept and the
+	// negotiated protocol and extensions
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		logf(r.Context(), "Error writing WebSocket handshake: %v", err)
+		return
+	}
+	metrics.successes.Add(1)
+	start := time.Now()
+
+	// Copy both ways until one side is done, then close both so the other
+	// copy returns too. Close frames pass through like any other frame.
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			conn.Close()
+			upstream.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		sent, _ = io.Copy(upstream, buf.Reader) // may hold bytes read past the handshake
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		received, _ = io.Copy(conn, upstream)
+	}()
+	wg.Wait()
+
+	metrics.bytesTransferred.Add(received)
+	promMetrics.bytesTransferred.Add(float64(received))
+	logf(r.Context(), "WebSocket to %s closed after %s (%d bytes sent, %d received)", targetURL, time.Since(start).Round(time.Millisecond), sent, received)
+}
+
+// webSocketToHTTP maps a ws:// or wss:// target onto the http:// or https://
+// URL its handshake is sent to.
+func webSocketToHTTP(target string) (string, bool) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		return "", false
+	}
+	switch strings.ToLower(scheme) {
+	case "ws":
+		return "http://" + rest, true
+	case "wss":
+		return "https://" + rest, true
+	}
+	return "", false
+}